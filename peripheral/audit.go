@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Record a write to a configuration register in the device log, before it
+// takes effect: the connection that wrote it, the register, its old and new
+// value and the ATT code the write was answered with. Writes to other
+// characteristics aren't recorded.
+//
+// The BlueZ backend reports every central as connection 0.
+func auditConfigWrite(client bluetooth.Connection, id bluetooth.UUID, value []byte, code byte) {
+	register, ok := configRegisterByUUID(id)
+	if !ok {
+		return
+	}
+
+	current := register.value(currentConfig())
+	newValue := fmt.Sprintf("0x%x", value)
+	if decoded, err := writeCodec(id, current).DecodeShort(value); err == nil {
+		newValue = fmt.Sprint(decoded)
+	}
+	appendConfigAudit(client, register.name, fmt.Sprint(current), newValue, code)
+}
+
+// Record a transaction item with a tag no register has, its value undecoded.
+func auditUnknownConfigTag(client bluetooth.Connection, tag byte, value []byte, code byte) {
+	appendConfigAudit(client, fmt.Sprintf("tag 0x%02X", tag), "?", fmt.Sprintf("0x%x", value), code)
+}
+
+// Append an audit record to the device log and keep it in NVM, so clearing the
+// log or a reset doesn't lose it. The kept records are capped like the log,
+// the oldest are dropped first.
+func appendConfigAudit(client bluetooth.Connection, name, oldValue, newValue string, code byte) {
+	result := "accepted"
+	if code != attSuccess {
+		result = fmt.Sprintf("rejected 0x%02X", code)
+	}
+	message := fmt.Sprintf("Config %s %s -> %s by connection %d, %s", name, oldValue, newValue, client, result)
+
+	deviceLogMutex.Lock()
+	entry := appendDeviceLog(time.Now().UnixMicro(), message)
+	updateNVM(func(nvm *nvmStruct) {
+		nvm.ConfigAudit = trimRecords(append(nvm.ConfigAudit, entry...), deviceLogMaxSize)
+	})
+	deviceLogMutex.Unlock()
+
+	objectMetadataChanged()
+}
+
+// The config audit records kept in NVM, the start of a cleared device log.
+func loadConfigAudit() []byte {
+	nvmMutex.Lock()
+	defer nvmMutex.Unlock()
+	return readNVM().ConfigAudit
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go-ble/record"
+)
+
+// The messages of the device log records
+func deviceLogMessages(t *testing.T) []string {
+	t.Helper()
+	var messages []string
+	for data := serializedDeviceLogData; len(data) > 0; {
+		frame, size, err := record.Decode(data)
+		if err != nil {
+			t.Fatalf("device log: %v", err)
+		}
+		log, err := frame.Log()
+		if err != nil {
+			t.Fatalf("device log: %v", err)
+		}
+		messages = append(messages, log.Message)
+		data = data[size:]
+	}
+	return messages
+}
+
+// Run the test with an empty device log and NVM and a known configuration.
+func useTestDeviceLog(t *testing.T) nvmConfigStruct {
+	savedPath, savedConfig, savedLog := nvmPath, currentConfig(), serializedDeviceLogData
+	t.Cleanup(func() { nvmPath, serializedDeviceLogData = savedPath, savedLog; setConfig(savedConfig) })
+	nvmPath = filepath.Join(t.TempDir(), "nvm.json")
+	serializedDeviceLogData = nil
+
+	config := savedConfig
+	config.SensorODR, config.TransmitPower = 2500, 0
+	setConfig(config)
+	return config
+}
+
+func TestAuditConfigTransaction(t *testing.T) {
+	useTestDeviceLog(t)
+
+	runConfigTransaction(0, []byte{configTagSensorODR, 2, 0xA0, 0x0F, 0x7F, 1, 0x2A})
+	runConfigTransaction(0, []byte{configTagSensorODR, 2, 0xA0, 0x0F})
+
+	want := []string{
+		"Config sensor ODR 2500 -> 4000 by connection 0, rejected 0x0A",
+		"Config tag 0x7F ? -> 0x2a by connection 0, rejected 0x0A",
+		"Config sensor ODR 2500 -> 4000 by connection 0, accepted",
+	}
+	if got := deviceLogMessages(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("device log %q, want %q", got, want)
+	}
+}
+
+func TestConfigAuditSurvivesClear(t *testing.T) {
+	useTestDeviceLog(t)
+
+	NewLogHandler(1, "Before the audit")
+	auditConfigWrite(0, transmitPowerCharacteristicUUID, []byte{0xFD}, attSuccess)
+	NewLogHandler(2, "After the audit")
+	clearDeviceLog("Device log cleared after the transfer")
+
+	want := []string{"Config transmit power 0 -> -3 by connection 0, accepted", "Device log cleared after the transfer"}
+	if got := deviceLogMessages(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("device log %q, want %q", got, want)
+	}
+
+	// Kept for the boot after a soft reset
+	if got := loadConfigAudit(); !strings.Contains(string(got), "transmit power 0 -> -3") {
+		t.Errorf("config audit in NVM %x, want the transmit power write", got)
+	}
+}
+
+func TestDeviceLogCapped(t *testing.T) {
+	useTestDeviceLog(t)
+
+	for i := range 40 {
+		auditConfigWrite(0, transmitPowerCharacteristicUUID, []byte{byte(i)}, attSuccess)
+	}
+	if len(serializedDeviceLogData) > deviceLogMaxSize {
+		t.Errorf("device log is %d bytes, want at most %d", len(serializedDeviceLogData), deviceLogMaxSize)
+	}
+	if audit := loadConfigAudit(); len(audit) > deviceLogMaxSize {
+		t.Errorf("config audit is %d bytes, want at most %d", len(audit), deviceLogMaxSize)
+	}
+
+	messages := deviceLogMessages(t)
+	if got, want := messages[len(messages)-1], fmt.Sprintf("Config transmit power 0 -> %d by connection 0, accepted", 39); got != want {
+		t.Errorf("newest record %q, want %q", got, want)
+	}
+	if strings.Contains(messages[0], "-> 0 ") {
+		t.Errorf("oldest record %q kept, want it dropped", messages[0])
+	}
+}
+
+func TestTrimRecords(t *testing.T) {
+	var data []byte
+	for i := range 3 {
+		data = record.AppendLog(data, uint32(i), 0, record.Log{Message: "0123456789"})
+	}
+	size := len(data) / 3
+
+	tests := []struct {
+		limit int
+		want  int // Records kept
+	}{
+		{len(data), 3},
+		{len(data) - 1, 2},
+		{2 * size, 2},
+		{size, 1},
+		{0, 1}, // The newest record is always kept
+	}
+	for _, test := range tests {
+		if got := trimRecords(data, test.limit); len(got) != test.want*size {
+			t.Errorf("limit %d: %d bytes, want %d records", test.limit, len(got), test.want)
+		}
+	}
+}
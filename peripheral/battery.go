@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Battery Power State (0x2A1A): four 2 bit fields, low to high: present,
+// discharging, charging and level.
+const (
+	batteryStatePresent        byte = 0b11 << 0
+	batteryStateDischarging    byte = 0b11 << 2
+	batteryStateNotDischarging byte = 0b10 << 2
+	batteryStateCharging       byte = 0b11 << 4
+	batteryStateNotCharging    byte = 0b10 << 4
+	batteryStateGoodLevel      byte = 0b10 << 6
+	batteryStateCriticallyLow  byte = 0b11 << 6
+)
+
+// Levels below this are reported as critically low
+const batteryCriticalLevel byte = 10
+
+var (
+	batteryMutex    sync.Mutex
+	batteryCharging bool = false // Simulated charger, toggled from the console
+)
+
+// Caller must hold batteryMutex.
+func batteryPowerState() byte {
+	state := batteryStatePresent
+	if batteryCharging {
+		state |= batteryStateCharging | batteryStateNotDischarging
+	} else {
+		state |= batteryStateNotCharging | batteryStateDischarging
+	}
+	if batteryPercentage < batteryCriticalLevel {
+		return state | batteryStateCriticallyLow
+	}
+	return state | batteryStateGoodLevel
+}
+
+// Battery level and power state, read under batteryMutex for callers outside
+// the battery handlers.
+func batteryLevel() (percentage, state byte) {
+	batteryMutex.Lock()
+	defer batteryMutex.Unlock()
+	return batteryPercentage, batteryPowerState()
+}
+
+// Publish the battery level on the standard Battery Level, its custom alias,
+// Battery Level State (level and power state) and Battery Power State.
+// Caller must hold batteryMutex.
+func publishBatteryLevel() {
+	state := batteryPowerState()
+	batteryLevelHandle.Write([]byte{batteryPercentage})
+	batteryPercentageHandle.Write([]byte{batteryPercentage})
+	batteryLevelStateHandle.Write([]byte{batteryPercentage, state})
+	batteryPowerStateHandle.Write([]byte{state})
+}
+
+// Drain the battery, or charge it while the simulated charger is connected.
+// The level stays within [0, 100].
+func batteryLevelHandler() {
+	for {
+		time.Sleep(time.Duration(15000+rand.Int()%10000) * time.Millisecond) // Randomized battery drain between 15 and 25 seconds per percent
+
+		batteryMutex.Lock()
+		switch {
+		case batteryCharging && batteryPercentage < 100:
+			batteryPercentage++
+		case !batteryCharging && batteryPercentage > 0:
+			batteryPercentage--
+		}
+		publishBatteryLevel()
+		batteryMutex.Unlock()
+	}
+}
+
+// Console command: battery <percent> | battery charge | battery discharge
+func batteryCommand(command string) {
+	batteryMutex.Lock()
+	defer batteryMutex.Unlock()
+
+	switch command = strings.TrimSpace(command); command {
+	case "charge":
+		batteryCharging = true
+		println("Battery charging.")
+	case "discharge":
+		batteryCharging = false
+		println("Battery discharging.")
+	default:
+		level, err := strconv.ParseUint(command, 10, 8)
+		if err != nil || level > 100 {
+			println("Usage: battery <percent> | battery charge | battery discharge")
+			return
+		}
+		batteryPercentage = byte(level)
+		println("Battery level set to:", batteryPercentage, "%")
+	}
+	publishBatteryLevel()
+}
@@ -0,0 +1,46 @@
+// Command dfusign signs a firmware image with the DFU test key and prints the
+// control point requests uploading it to the simulated peripheral.
+//
+//	dfusign -revision 0.2.0 image.bin
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"go-ble/dfu"
+)
+
+func main() {
+	revision := flag.String("revision", "", "firmware revision of the image")
+	flag.Parse()
+
+	if *revision == "" || len(*revision) > 255 || flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: dfusign -revision rev image.bin")
+		os.Exit(2)
+	}
+
+	image, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dfusign:", err)
+		os.Exit(1)
+	}
+
+	start := []byte{dfu.OpStart}
+	start = binary.LittleEndian.AppendUint32(start, uint32(len(image)))
+	start = binary.LittleEndian.AppendUint32(start, crc32.ChecksumIEEE(image))
+	start = append(start, byte(len(*revision)))
+	start = append(start, *revision...)
+
+	validate := append([]byte{dfu.OpValidate}, dfu.Sign(dfu.TestKey, *revision, image)...)
+
+	fmt.Println("size:    ", len(image))
+	fmt.Printf("crc32:    %08x\n", crc32.ChecksumIEEE(image))
+	fmt.Println("start:   ", hex.EncodeToString(start))
+	fmt.Println("validate:", hex.EncodeToString(validate))
+	fmt.Println("activate:", hex.EncodeToString([]byte{dfu.OpActivate}))
+}
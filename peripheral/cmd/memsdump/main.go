@@ -0,0 +1,136 @@
+// Command memsdump prints the records of captured serializedSensorData and
+// serializedDeviceLogData blobs.
+//
+//	memsdump [-format json|table] [file ...]
+//
+// With no files the blob is read from stdin. Damaged regions are reported on
+// stderr and make the command exit with status 1.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"go-ble/decode"
+)
+
+type jsonRecord struct {
+	File       string   `json:"file,omitempty"`
+	Offset     int      `json:"offset"`
+	ID         uint32   `json:"id"`
+	Type       string   `json:"type"`
+	Flags      uint16   `json:"flags"`
+	Timestamp  int64    `json:"timestamp"`
+	TimeLength uint32   `json:"time_length,omitempty"`
+	ODR        uint16   `json:"odr,omitempty"`
+	Data       string   `json:"data,omitempty"`
+	Samples    []uint16 `json:"samples,omitempty"`
+	Message    *string  `json:"message,omitempty"`
+}
+
+func main() {
+	format := flag.String("format", "json", "output format: json or table")
+	flag.Parse()
+
+	if *format != "json" && *format != "table" {
+		fmt.Fprintln(os.Stderr, "memsdump: unknown format", *format)
+		os.Exit(2)
+	}
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	damaged := false
+	for _, file := range files {
+		data, err := readInput(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "memsdump:", err)
+			os.Exit(2)
+		}
+
+		records, errs := decode.All(data)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "memsdump: %s: %v\n", file, err)
+			damaged = true
+		}
+
+		if *format == "table" {
+			err = printTable(os.Stdout, records)
+		} else {
+			err = printJSON(os.Stdout, file, len(files) > 1, records)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "memsdump:", err)
+			os.Exit(2)
+		}
+	}
+
+	if damaged {
+		os.Exit(1)
+	}
+}
+
+func readInput(file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
+}
+
+func printJSON(w io.Writer, file string, withFile bool, records []decode.Record) error {
+	encoder := json.NewEncoder(w)
+	for _, r := range records {
+		out := jsonRecord{
+			Offset: r.Offset,
+			ID:     r.ID,
+			Type:   r.Type.String(),
+			Flags:  r.Flags,
+		}
+		if withFile {
+			out.File = file
+		}
+		if r.Sensor != nil {
+			out.Timestamp = r.Sensor.Timestamp
+			out.TimeLength = r.Sensor.TimeLength
+			out.ODR = r.Sensor.ODR
+			out.Data = hex.EncodeToString(r.Sensor.Samples)
+			out.Samples = r.Sensor.Values()
+		}
+		if r.Log != nil {
+			out.Timestamp = r.Log.Timestamp
+			out.Message = &r.Log.Message
+		}
+		if err := encoder.Encode(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printTable(w io.Writer, records []decode.Record) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "OFFSET\tID\tTYPE\tTIME\tLENGTH\tODR\tDETAIL")
+	for _, r := range records {
+		switch {
+		case r.Sensor != nil:
+			fmt.Fprintf(tw, "%d\t%d\t%v\t%s\t%d us\t%d Hz\t%d samples\n",
+				r.Offset, r.ID, r.Type, formatTime(r.Sensor.Timestamp), r.Sensor.TimeLength, r.Sensor.ODR, len(r.Sensor.Values()))
+		case r.Log != nil:
+			fmt.Fprintf(tw, "%d\t%d\t%v\t%s\t\t\t%q\n",
+				r.Offset, r.ID, r.Type, formatTime(r.Log.Timestamp), r.Log.Message)
+		}
+	}
+	return tw.Flush()
+}
+
+func formatTime(us int64) string {
+	return time.UnixMicro(us).UTC().Format("2006-01-02 15:04:05.000000")
+}
@@ -0,0 +1,73 @@
+// Command memsexport converts the sensor records of captured
+// serializedSensorData blobs into WAV, CSV and NumPy files.
+//
+//	memsexport [-out dir] [-formats wav,csv,npy] [file ...]
+//
+// With no files the blob is read from stdin. Log records are ignored.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go-ble/decode"
+	"go-ble/export"
+)
+
+func main() {
+	out := flag.String("out", ".", "output directory")
+	formats := flag.String("formats", strings.Join(export.Formats, ","), "comma separated output formats")
+	flag.Parse()
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, "memsexport:", err)
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, file := range files {
+		var data []byte
+		var err error
+		if file == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(file)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "memsexport:", err)
+			os.Exit(2)
+		}
+
+		records, errs := decode.All(data)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "memsexport: %s: %v\n", file, err)
+			failed = true
+		}
+
+		for _, r := range records {
+			if r.Sensor == nil {
+				continue
+			}
+			written, err := export.WriteFiles(*out, r.ID, *r.Sensor, strings.Split(*formats, ","))
+			for _, path := range written {
+				fmt.Println(path)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "memsexport: record %d: %v\n", r.ID, err)
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
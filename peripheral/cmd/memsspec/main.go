@@ -0,0 +1,149 @@
+// Command memsspec renders the sensor records of captured serializedSensorData
+// blobs as PNG spectrograms with a waveform strip.
+//
+//	memsspec [-out dir] [-record id] [-batch file.png] [-window n] [file ...]
+//
+// A record holds too few samples for a spectrogram, so consecutive records with
+// the same ODR are joined into one segment first. Every segment is written to
+// <dir>/record_<first>-<last>.png, or all of them stacked into a single image
+// with -batch. -record renders only the segment the record was joined into.
+// Segments shorter than spectrogram.MinSamples are reported and skipped. With
+// no files the blob is read from stdin.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"go-ble/decode"
+	"go-ble/record"
+	"go-ble/spectrogram"
+)
+
+func main() {
+	out := flag.String("out", ".", "output directory for per record images")
+	recordID := flag.Int("record", -1, "render only the segment holding the record with this ID")
+	batch := flag.String("batch", "", "render all records into this single PNG")
+	var opts spectrogram.Options
+	flag.IntVar(&opts.Width, "width", 0, "image width in pixels")
+	flag.IntVar(&opts.Window, "window", 0, "STFT window in samples")
+	flag.IntVar(&opts.Hop, "hop", 0, "STFT hop in samples")
+	flag.Parse()
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	failed := false
+	var ids []uint32
+	var events []record.Sensor
+	for _, file := range files {
+		var data []byte
+		var err error
+		if file == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(file)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "memsspec:", err)
+			os.Exit(2)
+		}
+
+		records, errs := decode.All(data)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "memsspec: %s: %v\n", file, err)
+			failed = true
+		}
+		for _, r := range records {
+			if r.Sensor == nil {
+				continue
+			}
+			ids = append(ids, r.ID)
+			events = append(events, *r.Sensor)
+		}
+	}
+
+	if len(events) == 0 {
+		fmt.Fprintln(os.Stderr, "memsspec: no sensor records")
+		os.Exit(1)
+	}
+
+	joined := spectrogram.Join(ids, events)
+	if *recordID >= 0 {
+		joined = slices.DeleteFunc(joined, func(segment spectrogram.Segment) bool { return !segment.Contains(uint32(*recordID)) })
+		if len(joined) == 0 {
+			fmt.Fprintln(os.Stderr, "memsspec: no sensor record", *recordID)
+			os.Exit(1)
+		}
+	}
+
+	var segments []spectrogram.Segment
+	for _, segment := range joined {
+		if len(segment.Sensor.Values()) < spectrogram.MinSamples {
+			fmt.Fprintf(os.Stderr, "memsspec: %s: %d samples, at least %d needed\n", segment.Name(), len(segment.Sensor.Values()), spectrogram.MinSamples)
+			failed = true
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		os.Exit(1)
+	}
+
+	if *batch != "" {
+		var sensors []record.Sensor
+		for _, segment := range segments {
+			sensors = append(sensors, segment.Sensor)
+		}
+		img, err := spectrogram.RenderBatch(sensors, opts)
+		if err == nil {
+			err = writePNG(*batch, img)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "memsspec:", err)
+			os.Exit(1)
+		}
+		fmt.Println(*batch)
+	} else {
+		if err := os.MkdirAll(*out, 0o755); err != nil {
+			fmt.Fprintln(os.Stderr, "memsspec:", err)
+			os.Exit(2)
+		}
+		for _, segment := range segments {
+			path := filepath.Join(*out, segment.Name()+".png")
+			img, err := spectrogram.Render(segment.Sensor, opts)
+			if err == nil {
+				err = writePNG(path, img)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "memsspec:", err)
+				failed = true
+				continue
+			}
+			fmt.Println(path)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func writePNG(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := spectrogram.WritePNG(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
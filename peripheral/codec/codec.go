@@ -0,0 +1,406 @@
+// Package codec encodes and decodes characteristic values: signed and
+// unsigned 8 to 64 bit integers, fixed-point numbers, float32, bool, UTF-8
+// strings and byte arrays, with an explicit byte order.
+//
+// Decoded values have a canonical Go type per kind: int64 for signed
+// integers, uint64 for unsigned integers, float64 for fixed-point and float32
+// values, bool, string and []byte. Decode is the inverse of Encode; values
+// that don't fit or don't decode are reported as errors.
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// Kind is the encoding of a value.
+type Kind byte
+
+const (
+	Uint Kind = iota
+	Int
+	Fixed   // Integer scaled by 10^Exponent
+	Float32 // IEEE 754 single precision
+	Bool    // One byte, 0 or 1
+	String  // UTF-8
+	Bytes
+)
+
+var kindNames = [...]string{"uint", "int", "fixed", "float32", "bool", "string", "bytes"}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", byte(k))
+}
+
+var (
+	ErrLength = errors.New("codec: bad value length")
+	ErrRange  = errors.New("codec: value out of range")
+	ErrType   = errors.New("codec: unsupported value type")
+	ErrBool   = errors.New("codec: bool is neither 0 nor 1")
+	ErrUTF8   = errors.New("codec: invalid UTF-8")
+)
+
+// Codec describes the encoding of one value.
+type Codec struct {
+	Kind Kind
+	// Size in bytes. Integers and fixed-point take 1, 2, 4 or 8 bytes, float32
+	// and bool a fixed size, strings and byte arrays 0 for variable length.
+	Size     int
+	Signed   bool // Fixed-point only, integers are signed by Kind
+	Exponent int8 // Fixed-point only
+	Order    binary.ByteOrder
+}
+
+// Codecs of the common types, little endian.
+var (
+	U8   = Codec{Kind: Uint, Size: 1, Order: binary.LittleEndian}
+	U16  = Codec{Kind: Uint, Size: 2, Order: binary.LittleEndian}
+	U32  = Codec{Kind: Uint, Size: 4, Order: binary.LittleEndian}
+	U64  = Codec{Kind: Uint, Size: 8, Order: binary.LittleEndian}
+	I8   = Codec{Kind: Int, Size: 1, Order: binary.LittleEndian}
+	I16  = Codec{Kind: Int, Size: 2, Order: binary.LittleEndian}
+	I32  = Codec{Kind: Int, Size: 4, Order: binary.LittleEndian}
+	I64  = Codec{Kind: Int, Size: 8, Order: binary.LittleEndian}
+	F32  = Codec{Kind: Float32, Size: 4, Order: binary.LittleEndian}
+	B    = Codec{Kind: Bool, Size: 1, Order: binary.LittleEndian}
+	UTF8 = Codec{Kind: String, Order: binary.LittleEndian}
+	Raw  = Codec{Kind: Bytes, Order: binary.LittleEndian}
+)
+
+// FixedPoint returns a little endian fixed-point codec: value = raw * 10^exponent.
+func FixedPoint(size int, signed bool, exponent int8) Codec {
+	return Codec{Kind: Fixed, Size: size, Signed: signed, Exponent: exponent, Order: binary.LittleEndian}
+}
+
+// ByteArray returns a codec for byte arrays of exactly size bytes.
+func ByteArray(size int) Codec {
+	return Codec{Kind: Bytes, Size: size, Order: binary.LittleEndian}
+}
+
+// BigEndian returns the codec with big endian byte order.
+func (c Codec) BigEndian() Codec {
+	c.Order = binary.BigEndian
+	return c
+}
+
+func (c Codec) String() string {
+	s := c.Kind.String()
+	switch c.Kind {
+	case Uint, Int:
+		s += fmt.Sprint(8 * c.Size)
+	case Fixed:
+		s = fmt.Sprintf("fixed%d(10^%d)", 8*c.Size, c.Exponent)
+		if c.Signed {
+			s = "s" + s
+		}
+	case Bytes:
+		if c.Size > 0 {
+			s += fmt.Sprintf("[%d]", c.Size)
+		}
+	}
+	if c.Order == binary.BigEndian {
+		s += " big endian"
+	}
+	return s
+}
+
+// Encode encodes v. Integers of any Go type are accepted by the integer and
+// fixed-point codecs, floats by the float and fixed-point codecs.
+func (c Codec) Encode(v any) ([]byte, error) {
+	switch c.Kind {
+	case Uint:
+		n, err := toUint(v, c.Size)
+		if err != nil {
+			return nil, err
+		}
+		return c.putUint(n), nil
+	case Int:
+		n, err := toInt(v, c.Size)
+		if err != nil {
+			return nil, err
+		}
+		return c.putUint(uint64(n)), nil
+	case Fixed:
+		f, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		raw := math.Round(f / math.Pow10(int(c.Exponent)))
+		if c.Signed {
+			n, err := toInt(raw, c.Size)
+			if err != nil {
+				return nil, err
+			}
+			return c.putUint(uint64(n)), nil
+		}
+		n, err := toUint(raw, c.Size)
+		if err != nil {
+			return nil, err
+		}
+		return c.putUint(n), nil
+	case Float32:
+		f, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if !math.IsInf(f, 0) && math.Abs(f) > math.MaxFloat32 {
+			return nil, ErrRange
+		}
+		return c.putUint(uint64(math.Float32bits(float32(f)))), nil
+	case Bool:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%w %T for %s", ErrType, v, c)
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case String:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w %T for %s", ErrType, v, c)
+		}
+		if !utf8.ValidString(s) {
+			return nil, ErrUTF8
+		}
+		return []byte(s), nil
+	case Bytes:
+		b, ok := v.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("%w %T for %s", ErrType, v, c)
+		}
+		if c.Size > 0 && len(b) != c.Size {
+			return nil, ErrLength
+		}
+		return bytes.Clone(b), nil
+	}
+	return nil, fmt.Errorf("%w: kind %s", ErrType, c.Kind)
+}
+
+// Decode decodes b, the value must have exactly the codec size.
+func (c Codec) Decode(b []byte) (any, error) {
+	if c.Size > 0 && len(b) != c.Size {
+		return nil, ErrLength
+	}
+
+	switch c.Kind {
+	case Uint:
+		return c.uint(b), nil
+	case Int:
+		return c.int(b), nil
+	case Fixed:
+		scale := math.Pow10(int(c.Exponent))
+		if c.Signed {
+			return float64(c.int(b)) * scale, nil
+		}
+		return float64(c.uint(b)) * scale, nil
+	case Float32:
+		return float64(math.Float32frombits(uint32(c.uint(b)))), nil
+	case Bool:
+		switch b[0] {
+		case 0:
+			return false, nil
+		case 1:
+			return true, nil
+		}
+		return nil, ErrBool
+	case String:
+		if !utf8.Valid(b) {
+			return nil, ErrUTF8
+		}
+		return string(b), nil
+	case Bytes:
+		return bytes.Clone(b), nil
+	}
+	return nil, fmt.Errorf("%w: kind %s", ErrType, c.Kind)
+}
+
+// DecodeShort decodes integers shorter than the codec size, as written by
+// centrals that drop the high zero bytes of small values: a 1 byte write to a
+// uint16 characteristic. Signed values are sign extended. Other kinds decode
+// as Decode does.
+func (c Codec) DecodeShort(b []byte) (any, error) {
+	if c.Kind != Uint && c.Kind != Int {
+		return c.Decode(b)
+	}
+	if len(b) == 0 || len(b) > c.Size {
+		return nil, ErrLength
+	}
+
+	short := c
+	short.Size = len(b)
+	return short.Decode(b)
+}
+
+func (c Codec) putUint(n uint64) []byte {
+	b := make([]byte, 8)
+	if c.Order == binary.BigEndian {
+		binary.BigEndian.PutUint64(b, n)
+		return b[8-c.Size:]
+	}
+	binary.LittleEndian.PutUint64(b, n)
+	return b[:c.Size]
+}
+
+func (c Codec) uint(b []byte) uint64 {
+	var n uint64
+	for i := range b {
+		if c.Order == binary.BigEndian {
+			n = n<<8 | uint64(b[i])
+		} else {
+			n = n<<8 | uint64(b[len(b)-1-i])
+		}
+	}
+	return n
+}
+
+func (c Codec) int(b []byte) int64 {
+	shift := 64 - 8*len(b)
+	return int64(c.uint(b)<<shift) >> shift
+}
+
+func toUint(v any, size int) (uint64, error) {
+	var n uint64
+	switch x := v.(type) {
+	case uint8:
+		n = uint64(x)
+	case uint16:
+		n = uint64(x)
+	case uint32:
+		n = uint64(x)
+	case uint64:
+		n = x
+	case uint:
+		n = uint64(x)
+	case int8, int16, int32, int64, int, float64:
+		i, err := toInt(x, 8)
+		if err != nil || i < 0 {
+			return 0, ErrRange
+		}
+		n = uint64(i)
+	default:
+		return 0, fmt.Errorf("%w %T", ErrType, v)
+	}
+	if size < 8 && n >= 1<<(8*size) {
+		return 0, ErrRange
+	}
+	return n, nil
+}
+
+func toInt(v any, size int) (int64, error) {
+	var n int64
+	switch x := v.(type) {
+	case int8:
+		n = int64(x)
+	case int16:
+		n = int64(x)
+	case int32:
+		n = int64(x)
+	case int64:
+		n = x
+	case int:
+		n = int64(x)
+	case uint8:
+		n = int64(x)
+	case uint16:
+		n = int64(x)
+	case uint32:
+		n = int64(x)
+	case uint64:
+		if x > math.MaxInt64 {
+			return 0, ErrRange
+		}
+		n = int64(x)
+	case uint:
+		if uint64(x) > math.MaxInt64 {
+			return 0, ErrRange
+		}
+		n = int64(x)
+	case float64:
+		if x != math.Trunc(x) || x < math.MinInt64 || x >= math.MaxInt64 {
+			return 0, ErrRange
+		}
+		n = int64(x)
+	default:
+		return 0, fmt.Errorf("%w %T", ErrType, v)
+	}
+	if size < 8 && (n < -1<<(8*size-1) || n >= 1<<(8*size-1)) {
+		return 0, ErrRange
+	}
+	return n, nil
+}
+
+func toFloat(v any) (float64, error) {
+	switch x := v.(type) {
+	case float32:
+		return float64(x), nil
+	case float64:
+		return x, nil
+	}
+	n, err := toInt(v, 8)
+	if err != nil {
+		if u, uerr := toUint(v, 8); uerr == nil {
+			return float64(u), nil
+		}
+		return 0, err
+	}
+	return float64(n), nil
+}
+
+// Float returns a decoded numeric value as float64, bools as 0 or 1.
+func Float(v any) (float64, bool) {
+	switch x := v.(type) {
+	case uint64:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Native returns the codec matching the Go type of v, for the integer, bool,
+// float32, string and []byte types.
+func Native(v any) (Codec, error) {
+	switch v.(type) {
+	case uint8:
+		return U8, nil
+	case uint16:
+		return U16, nil
+	case uint32:
+		return U32, nil
+	case uint64, uint:
+		return U64, nil
+	case int8:
+		return I8, nil
+	case int16:
+		return I16, nil
+	case int32:
+		return I32, nil
+	case int64, int:
+		return I64, nil
+	case float32:
+		return F32, nil
+	case bool:
+		return B, nil
+	case string:
+		return UTF8, nil
+	case []byte:
+		return Raw, nil
+	}
+	return Codec{}, fmt.Errorf("%w %T", ErrType, v)
+}
@@ -0,0 +1,185 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		codec   Codec
+		value   any // Encoded
+		encoded []byte
+		decoded any // Canonical Go type
+	}{
+		{"u8", U8, uint8(0xAB), []byte{0xAB}, uint64(0xAB)},
+		{"u16", U16, uint16(0x1234), []byte{0x34, 0x12}, uint64(0x1234)},
+		{"u32", U32, uint32(0x12345678), []byte{0x78, 0x56, 0x34, 0x12}, uint64(0x12345678)},
+		{"u64", U64, uint64(math.MaxUint64), bytes.Repeat([]byte{0xFF}, 8), uint64(math.MaxUint64)},
+		{"i8", I8, int8(-3), []byte{0xFD}, int64(-3)},
+		{"i16", I16, int16(-2), []byte{0xFE, 0xFF}, int64(-2)},
+		{"i32", I32, int32(math.MinInt32), []byte{0x00, 0x00, 0x00, 0x80}, int64(math.MinInt32)},
+		{"i64", I64, int64(-1), bytes.Repeat([]byte{0xFF}, 8), int64(-1)},
+		{"u16 from int", U16, 500, []byte{0xF4, 0x01}, uint64(500)},
+		{"i16 from uint8", I16, uint8(200), []byte{0xC8, 0x00}, int64(200)},
+		{"u16 from integral float64", U16, float64(1000), []byte{0xE8, 0x03}, uint64(1000)},
+		{"u16 big endian", U16.BigEndian(), uint16(0x1234), []byte{0x12, 0x34}, uint64(0x1234)},
+		{"i32 big endian", I32.BigEndian(), int32(-2), []byte{0xFF, 0xFF, 0xFF, 0xFE}, int64(-2)},
+		{"u64 big endian", U64.BigEndian(), uint64(0x0102030405060708), []byte{1, 2, 3, 4, 5, 6, 7, 8}, uint64(0x0102030405060708)},
+		{"fixed 0.01", FixedPoint(2, false, -2), 12.34, []byte{0xD2, 0x04}, 12.34},
+		{"signed fixed 0.1", FixedPoint(2, true, -1), -0.5, []byte{0xFB, 0xFF}, -0.5},
+		{"fixed 10^2", FixedPoint(1, false, 2), 300, []byte{0x03}, float64(300)},
+		{"fixed big endian", FixedPoint(2, false, -2).BigEndian(), 12.34, []byte{0x04, 0xD2}, 12.34},
+		{"float32", F32, float32(1.5), []byte{0x00, 0x00, 0xC0, 0x3F}, 1.5},
+		{"float32 from float64", F32, -2.0, []byte{0x00, 0x00, 0x00, 0xC0}, -2.0},
+		{"float32 big endian", F32.BigEndian(), float32(1.5), []byte{0x3F, 0xC0, 0x00, 0x00}, 1.5},
+		{"float32 infinity", F32, math.Inf(1), []byte{0x00, 0x00, 0x80, 0x7F}, math.Inf(1)},
+		{"bool false", B, false, []byte{0}, false},
+		{"bool true", B, true, []byte{1}, true},
+		{"string", UTF8, "Sensor µ", []byte("Sensor µ"), "Sensor µ"},
+		{"empty string", UTF8, "", []byte{}, ""},
+		{"bytes", Raw, []byte{1, 2, 3}, []byte{1, 2, 3}, []byte{1, 2, 3}},
+		{"fixed size bytes", ByteArray(2), []byte{9, 8}, []byte{9, 8}, []byte{9, 8}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := test.codec.Encode(test.value)
+			if err != nil {
+				t.Fatalf("Encode(%v): %v", test.value, err)
+			}
+			if !bytes.Equal(encoded, test.encoded) {
+				t.Fatalf("Encode(%v) = %x, want %x", test.value, encoded, test.encoded)
+			}
+
+			decoded, err := test.codec.Decode(encoded)
+			if err != nil {
+				t.Fatalf("Decode(%x): %v", encoded, err)
+			}
+			if f, ok := decoded.(float64); ok && test.codec.Kind == Fixed {
+				// Scaling by a power of 10 isn't exact in binary
+				if want := test.decoded.(float64); math.Abs(f-want) > 1e-9 {
+					t.Fatalf("Decode(%x) = %v, want %v", encoded, f, want)
+				}
+				return
+			}
+			if !reflect.DeepEqual(decoded, test.decoded) {
+				t.Fatalf("Decode(%x) = %#v, want %#v", encoded, decoded, test.decoded)
+			}
+		})
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+		value any
+		err   error
+	}{
+		{"u8 overflow", U8, 256, ErrRange},
+		{"u16 overflow", U16, uint32(70000), ErrRange},
+		{"negative unsigned", U32, -1, ErrRange},
+		{"i8 overflow", I8, 128, ErrRange},
+		{"i8 underflow", I8, int16(-129), ErrRange},
+		{"i64 from huge uint64", I64, uint64(math.MaxUint64), ErrRange},
+		{"fractional float to integer", U16, 1.5, ErrRange},
+		{"fixed overflow", FixedPoint(1, false, -1), 25.6, ErrRange},
+		{"signed fixed underflow", FixedPoint(1, true, 0), -129, ErrRange},
+		{"float32 overflow", F32, math.MaxFloat64, ErrRange},
+		{"string to integer", U8, "1", ErrType},
+		{"integer to bool", B, 1, ErrType},
+		{"bytes to string", UTF8, []byte("a"), ErrType},
+		{"invalid UTF-8", UTF8, "\xff", ErrUTF8},
+		{"fixed size bytes", ByteArray(2), []byte{1}, ErrLength},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.codec.Encode(test.value); !errors.Is(err, test.err) {
+				t.Fatalf("Encode(%v) error %v, want %v", test.value, err, test.err)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		codec   Codec
+		encoded []byte
+		err     error
+	}{
+		{"u16 short", U16, []byte{1}, ErrLength},
+		{"u16 long", U16, []byte{1, 2, 3}, ErrLength},
+		{"i64 empty", I64, nil, ErrLength},
+		{"float32 short", F32, []byte{0, 0, 0}, ErrLength},
+		{"fixed long", FixedPoint(2, false, -2), []byte{1, 2, 3}, ErrLength},
+		{"bool empty", B, nil, ErrLength},
+		{"bool 2", B, []byte{2}, ErrBool},
+		{"invalid UTF-8", UTF8, []byte{0xC3}, ErrUTF8},
+		{"fixed size bytes", ByteArray(4), []byte{1, 2}, ErrLength},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.codec.Decode(test.encoded); !errors.Is(err, test.err) {
+				t.Fatalf("Decode(%x) error %v, want %v", test.encoded, err, test.err)
+			}
+		})
+	}
+}
+
+func TestDecodeShort(t *testing.T) {
+	tests := []struct {
+		name    string
+		codec   Codec
+		encoded []byte
+		decoded any
+		err     error
+	}{
+		{"u16 from 1 byte", U16, []byte{0xC8}, uint64(200), nil},
+		{"u16 from 2 bytes", U16, []byte{0x2C, 0x01}, uint64(300), nil},
+		{"i16 sign extended", I16, []byte{0xFD}, int64(-3), nil},
+		{"i32 sign extended", I32, []byte{0x00, 0x80}, int64(math.MinInt16), nil},
+		{"i16 positive", I16, []byte{0x7F}, int64(127), nil},
+		{"i16 big endian sign extended", I16.BigEndian(), []byte{0xFE}, int64(-2), nil},
+		{"u32 big endian from 2 bytes", U32.BigEndian(), []byte{0x01, 0x02}, uint64(0x0102), nil},
+		{"empty", U16, []byte{}, nil, ErrLength},
+		{"longer than the codec", U16, []byte{1, 2, 3}, nil, ErrLength},
+		{"other kinds decode whole", F32, []byte{0, 0}, nil, ErrLength},
+		{"bool", B, []byte{1}, true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := test.codec.DecodeShort(test.encoded)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("DecodeShort(%x) error %v, want %v", test.encoded, err, test.err)
+			}
+			if err == nil && !reflect.DeepEqual(decoded, test.decoded) {
+				t.Fatalf("DecodeShort(%x) = %#v, want %#v", test.encoded, decoded, test.decoded)
+			}
+		})
+	}
+}
+
+func TestNative(t *testing.T) {
+	tests := []struct {
+		value any
+		codec Codec
+	}{
+		{uint8(0), U8}, {uint16(0), U16}, {uint32(0), U32}, {uint64(0), U64}, {uint(0), U64},
+		{int8(0), I8}, {int16(0), I16}, {int32(0), I32}, {int64(0), I64}, {0, I64},
+		{float32(0), F32}, {false, B}, {"", UTF8}, {[]byte{}, Raw},
+	}
+	for _, test := range tests {
+		c, err := Native(test.value)
+		if err != nil || c != test.codec {
+			t.Errorf("Native(%T) = %v, %v, want %v", test.value, c, err, test.codec)
+		}
+	}
+	if _, err := Native(1.5); !errors.Is(err, ErrType) {
+		t.Errorf("Native(float64) error %v, want %v", err, ErrType)
+	}
+}
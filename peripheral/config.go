@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go-ble/schema"
+
+	"github.com/google/uuid"
+	"tinygo.org/x/bluetooth"
+)
+
+// Default configuration file, read if present
+const defaultConfigPath = "peripheral.json"
+
+// The app's characteristic description, relative to the peripheral directory
+const defaultSchemaPath = "../assets/ble_characteristics.json"
+
+// Device identity and defaults, loaded from the configuration file, then the
+// MEMS_* environment variables, then the command line flags.
+type peripheralConfigStruct struct {
+	DeviceName       string `json:"device_name"`
+	TotalMemory      uint64 `json:"total_memory"`
+	FirmwareRevision string `json:"firmware_revision"`
+	ManufacturerName string `json:"manufacturer_name"`
+	ModelNumber      string `json:"model_number"`
+	SerialNumber     string `json:"serial_number"`
+	HardwareRevision string `json:"hardware_revision"`
+	SystemID         uint64 `json:"system_id"` // OUI in the high 24 bits, manufacturer identifier in the low 40
+	MaxTransferChunk int    `json:"max_transfer_chunk"`
+	NVMPath          string `json:"nvm_path"`
+	SensorFlashPath  string `json:"sensor_flash_path"`
+	SchemaPath       string `json:"schema_path"`
+
+	// Register values the device starts with and returns to on factory reset
+	Defaults nvmConfigStruct `json:"defaults"`
+
+	// Characteristic and service UUID overrides by name, see configurableUUIDs
+	UUIDs map[string]string `json:"uuids"`
+}
+
+// UUIDs that can be overridden, by configuration name
+var configurableUUIDs = map[string]*bluetooth.UUID{
+	"firmware_revision":          &fwRevisionUUID,
+	"reboot":                     &rebootCharacteristicUUID,
+	"boot_count":                 &bootCountCharacteristicUUID,
+	"last_reset_reason":          &lastResetReasonCharacteristicUUID,
+	"factory_reset":              &factoryResetCharacteristicUUID,
+	"write_status":               &writeStatusCharacteristicUUID,
+	"config_transaction":         &configTransactionCharacteristicUUID,
+	"config_generation":          &configGenerationCharacteristicUUID,
+	"config_changed_at":          &configChangedAtCharacteristicUUID,
+	"battery_percentage":         &batteryPercentageUUID,
+	"device_log":                 &deviceLogCharacteristicUUID,
+	"device_log_length":          &deviceLogLengthCharacteristicUUID,
+	"unix_time_sync":             &unixTimeSyncCharacteristicUUID,
+	"memory_allocated":           &memoryAllocatedPercentageCharacteristicUUID,
+	"sensor_data_clear_bit":      &sensorDataClearBitCharacteristicUUID,
+	"auto_disconnect_bit":        &autoDisconnectBitCharacteristicUUID,
+	"sensor_odr":                 &sensorODRCharacteristicUUID,
+	"sensor_data":                &sensorDataCharacteristicUUID,
+	"sensor_data_chunk_size":     &sensorDataChunkSizeCharacteristicUUID,
+	"att_mtu":                    &attMTUCharacteristicUUID,
+	"sensor_data_ack":            &sensorDataAckCharacteristicUUID,
+	"sensor_data_digest":         &sensorDataDigestCharacteristicUUID,
+	"sensor_data_digest_confirm": &sensorDataDigestConfirmCharacteristicUUID,
+	"sensor_data_stream":         &sensorDataStreamCharacteristicUUID,
+	"stream_control":             &sensorDataStreamControlCharacteristicUUID,
+	"stream_stats":               &sensorDataStreamStatsCharacteristicUUID,
+	"sensor_data_catalog":        &sensorDataCatalogCharacteristicUUID,
+	"sensor_data_request":        &sensorDataRequestCharacteristicUUID,
+	"sensor_data_total":          &sensorDataTotalCharacteristicUUID,
+	"transmit_power":             &transmitPowerCharacteristicUUID,
+	"adv_interval_global":        &advIntervalGlobalCharacteristicUUID,
+	"adv_duration":               &advDurationCharacteristicUUID,
+	"adv_interval_local":         &advIntervalLocalCharacteristicUUID,
+	"response_timeout":           &responseTimeoutCharacteristicUUID,
+	"confirm_read":               &confirmReadUUID,
+	"object_data":                &objectDataCharacteristicUUID,
+	"dfu_service":                &dfuServiceUUID,
+	"dfu_control":                &dfuControlCharacteristicUUID,
+	"dfu_data":                   &dfuDataCharacteristicUUID,
+	"dfu_status":                 &dfuStatusCharacteristicUUID,
+}
+
+// A scalar setting, available as MEMS_<NAME> in the environment and -<name> on the command line
+type configSettingStruct struct {
+	name  string
+	usage string
+	set   func(config *peripheralConfigStruct, value string) error
+}
+
+var configSettings = []configSettingStruct{
+	{"device-name", "advertised device name", func(c *peripheralConfigStruct, v string) error {
+		c.DeviceName = v
+		return nil
+	}},
+	{"total-memory", "sensor data memory in bytes", func(c *peripheralConfigStruct, v string) error {
+		return parseUint(v, 64, &c.TotalMemory)
+	}},
+	{"firmware-revision", "factory firmware revision", func(c *peripheralConfigStruct, v string) error {
+		c.FirmwareRevision = v
+		return nil
+	}},
+	{"manufacturer-name", "Device Information manufacturer name", func(c *peripheralConfigStruct, v string) error {
+		c.ManufacturerName = v
+		return nil
+	}},
+	{"model-number", "Device Information model number", func(c *peripheralConfigStruct, v string) error {
+		c.ModelNumber = v
+		return nil
+	}},
+	{"serial-number", "Device Information serial number", func(c *peripheralConfigStruct, v string) error {
+		c.SerialNumber = v
+		return nil
+	}},
+	{"hardware-revision", "Device Information hardware revision", func(c *peripheralConfigStruct, v string) error {
+		c.HardwareRevision = v
+		return nil
+	}},
+	{"system-id", "Device Information system ID, OUI in the high 24 bits, manufacturer identifier in the low 40", func(c *peripheralConfigStruct, v string) error {
+		return parseUint(v, 64, &c.SystemID)
+	}},
+	{"max-transfer-chunk", "preferred sensor data chunk size in bytes", func(c *peripheralConfigStruct, v string) error {
+		n, err := strconv.Atoi(v)
+		c.MaxTransferChunk = n
+		return err
+	}},
+	{"nvm-path", "file holding the simulated NVM", func(c *peripheralConfigStruct, v string) error {
+		c.NVMPath = v
+		return nil
+	}},
+	{"sensor-flash-path", "file holding the simulated sensor data flash", func(c *peripheralConfigStruct, v string) error {
+		c.SensorFlashPath = v
+		return nil
+	}},
+	{"schema-path", "characteristic schema shared with the app", func(c *peripheralConfigStruct, v string) error {
+		c.SchemaPath = v
+		return nil
+	}},
+	{"sensor-odr", "default sensor ODR in Hz", func(c *peripheralConfigStruct, v string) error {
+		return parseUint(v, 16, &c.Defaults.SensorODR)
+	}},
+	{"transmit-power", "default transmit power in dBm", func(c *peripheralConfigStruct, v string) error {
+		return parseInt(v, 8, &c.Defaults.TransmitPower)
+	}},
+	{"adv-interval-global", "default interval between advertising sessions", func(c *peripheralConfigStruct, v string) error {
+		return parseUint(v, 16, &c.Defaults.AdvIntervalGlobal)
+	}},
+	{"adv-duration", "default advertising session duration", func(c *peripheralConfigStruct, v string) error {
+		return parseUint(v, 16, &c.Defaults.AdvDuration)
+	}},
+	{"adv-interval-local", "default BLE core advertising interval", func(c *peripheralConfigStruct, v string) error {
+		return parseUint(v, 16, &c.Defaults.AdvIntervalLocal)
+	}},
+	{"response-timeout", "default connect response timeout", func(c *peripheralConfigStruct, v string) error {
+		return parseUint(v, 8, &c.Defaults.ResponseTimeout)
+	}},
+	{"auto-disconnect-bit", "default auto disconnect bit", func(c *peripheralConfigStruct, v string) error {
+		return parseUint(v, 8, &c.Defaults.AutoDisconnectBit)
+	}},
+	{"sensor-data-clear-bit", "default sensor data clear bit", func(c *peripheralConfigStruct, v string) error {
+		return parseUint(v, 8, &c.Defaults.SensorDataClearBit)
+	}},
+}
+
+func parseUint[T uint8 | uint16 | uint64](value string, bits int, result *T) error {
+	n, err := strconv.ParseUint(value, 0, bits)
+	*result = T(n)
+	return err
+}
+
+func parseInt[T int8 | int16](value string, bits int, result *T) error {
+	n, err := strconv.ParseInt(value, 0, bits)
+	*result = T(n)
+	return err
+}
+
+// The configuration compiled into the peripheral.
+func builtinConfig() peripheralConfigStruct {
+	return peripheralConfigStruct{
+		DeviceName:       deviceName,
+		TotalMemory:      totalMemory,
+		FirmwareRevision: fwRevision,
+		ManufacturerName: manufacturerName,
+		ModelNumber:      modelNumber,
+		SerialNumber:     serialNumber,
+		HardwareRevision: hardwareRevision,
+		SystemID:         systemID,
+		MaxTransferChunk: sensorDataMaxTransferChunk,
+		NVMPath:          nvmPath,
+		SensorFlashPath:  sensorFlashPath,
+		SchemaPath:       defaultSchemaPath,
+		Defaults:         factoryConfig,
+	}
+}
+
+// Load the configuration: built in values, overridden by the configuration
+// file, the environment and the command line, in that order.
+func loadPeripheralConfig(args []string) (peripheralConfigStruct, error) {
+	config := builtinConfig()
+
+	flags := flag.NewFlagSet("peripheral", flag.ContinueOnError)
+	configPath := flags.String("config", "", "configuration file (default "+defaultConfigPath+" if present, or MEMS_CONFIG)")
+
+	overrides := map[string]string{}
+	for _, setting := range configSettings {
+		flags.Func(setting.name, setting.usage, func(value string) error {
+			overrides[setting.name] = value
+			return nil
+		})
+	}
+	uuidOverrides := map[string]string{}
+	flags.Func("uuid", "override a UUID, name=uuid, may be repeated", func(value string) error {
+		name, id, ok := strings.Cut(value, "=")
+		if !ok {
+			return errors.New("expected name=uuid")
+		}
+		uuidOverrides[name] = id
+		return nil
+	})
+
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	path, explicit := *configPath, *configPath != ""
+	if !explicit {
+		path, explicit = os.LookupEnv("MEMS_CONFIG")
+	}
+	if !explicit {
+		path = defaultConfigPath
+	}
+	if err := readConfigFile(path, &config); err != nil && (explicit || !errors.Is(err, fs.ErrNotExist)) {
+		return config, err
+	}
+
+	for _, setting := range configSettings {
+		env := "MEMS_" + strings.ToUpper(strings.ReplaceAll(setting.name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok {
+			if err := setting.set(&config, value); err != nil {
+				return config, fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+	for _, setting := range configSettings {
+		if value, ok := overrides[setting.name]; ok {
+			if err := setting.set(&config, value); err != nil {
+				return config, fmt.Errorf("-%s: %w", setting.name, err)
+			}
+		}
+	}
+	for name, id := range uuidOverrides {
+		if config.UUIDs == nil {
+			config.UUIDs = map[string]string{}
+		}
+		config.UUIDs[name] = id
+	}
+
+	return config, config.validate()
+}
+
+func readConfigFile(path string, config *peripheralConfigStruct) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (config peripheralConfigStruct) validate() error {
+	var errs []error
+
+	if config.DeviceName == "" || len(config.DeviceName) > 248 {
+		errs = append(errs, errors.New("device_name must be 1 to 248 bytes long"))
+	}
+	if config.TotalMemory == 0 {
+		errs = append(errs, errors.New("total_memory must not be 0"))
+	}
+	// Device Information strings, each one is a whole attribute value
+	for _, field := range []struct{ name, value string }{
+		{"firmware_revision", config.FirmwareRevision},
+		{"manufacturer_name", config.ManufacturerName},
+		{"model_number", config.ModelNumber},
+		{"serial_number", config.SerialNumber},
+		{"hardware_revision", config.HardwareRevision},
+	} {
+		if field.value == "" || len(field.value) > maxAttributeLength {
+			errs = append(errs, fmt.Errorf("%s must be 1 to %d bytes long", field.name, maxAttributeLength))
+		}
+	}
+	if config.MaxTransferChunk < minTransferChunk || config.MaxTransferChunk > maxTransferChunk {
+		errs = append(errs, fmt.Errorf("max_transfer_chunk must be within [%d, %d]", minTransferChunk, maxTransferChunk))
+	}
+	if config.NVMPath == "" {
+		errs = append(errs, errors.New("nvm_path must not be empty"))
+	}
+	if config.SensorFlashPath == "" {
+		errs = append(errs, errors.New("sensor_flash_path must not be empty"))
+	}
+	if config.SchemaPath == "" {
+		errs = append(errs, errors.New("schema_path must not be empty"))
+	}
+	if config.Defaults.SensorODR == 0 {
+		errs = append(errs, errors.New("defaults.sensor_odr must not be 0"))
+	}
+	if config.Defaults.AutoDisconnectBit > 1 || config.Defaults.SensorDataClearBit > 1 {
+		errs = append(errs, errors.New("defaults bits must be 0 or 1"))
+	}
+
+	for name, id := range config.UUIDs {
+		if _, ok := configurableUUIDs[name]; !ok {
+			errs = append(errs, fmt.Errorf("uuids: unknown name %q", name))
+			continue
+		}
+		if _, err := uuid.Parse(id); err != nil {
+			errs = append(errs, fmt.Errorf("uuids.%s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Check the configuration once it and the schema UUIDs are applied, the schema
+// may move characteristics onto UUIDs the configuration uses: every UUID must
+// be unique and the register defaults must be values a central could write.
+// UUIDs the schema sets can't be overridden, the app would no longer find them.
+func validateAppliedConfig(config peripheralConfigStruct, s *schema.Schema) error {
+	var errs []error
+
+	for _, c := range s.Characteristics {
+		if _, ok := config.UUIDs[c.Key]; ok && c.Key != "" {
+			errs = append(errs, fmt.Errorf("uuids.%s: set to %s by the schema, change the schema instead", c.Key, c.UUID))
+		}
+	}
+
+	users := map[bluetooth.UUID]string{}
+	for _, name := range slices.Sorted(maps.Keys(configurableUUIDs)) {
+		id := *configurableUUIDs[name]
+		if other, ok := users[id]; ok {
+			errs = append(errs, fmt.Errorf("uuids: %s and %s share %s", other, name, id.String()))
+		}
+		users[id] = name
+	}
+
+	for _, tag := range slices.Sorted(maps.Keys(configRegisters)) {
+		register := configRegisters[tag]
+		name := users[*register.uuid]
+		value := register.value(factoryConfig)
+		n := reflect.ValueOf(value).Convert(reflect.TypeFor[float64]()).Float()
+
+		c, described := s.Characteristic(register.uuid.String())
+		if described && c.DataType.Integer() && c.DataType != schema.Bool {
+			if _, err := c.DataType.Codec().Encode(n); err != nil {
+				errs = append(errs, fmt.Errorf("defaults.%s: %v doesn't fit in the schema type %s", name, value, c.DataType))
+				continue
+			}
+		}
+		if code := checkWriteRules(writeRules(*register.uuid, c, described), n); code != attSuccess {
+			errs = append(errs, fmt.Errorf("defaults.%s: %v is rejected by the characteristic rules, error 0x%02X", name, value, code))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Make the configuration current. Must run before the GATT stack is built.
+func applyPeripheralConfig(config peripheralConfigStruct) {
+	deviceName = config.DeviceName
+	totalMemory = config.TotalMemory
+	fwRevision = config.FirmwareRevision
+	manufacturerName = config.ManufacturerName
+	modelNumber = config.ModelNumber
+	serialNumber = config.SerialNumber
+	hardwareRevision = config.HardwareRevision
+	systemID = config.SystemID
+	sensorDataMaxTransferChunk = config.MaxTransferChunk
+	nvmPath = config.NVMPath
+	sensorFlashPath = config.SensorFlashPath
+
+	factoryConfig = config.Defaults
+	setConfig(config.Defaults)
+
+	for name, id := range config.UUIDs {
+		*configurableUUIDs[name] = bluetooth.NewUUID(uuid.MustParse(id))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go-ble/schema"
+)
+
+func TestValidateAppliedConfig(t *testing.T) {
+	savedConfig, savedUUID := factoryConfig, transmitPowerCharacteristicUUID
+	defer func() { factoryConfig, transmitPowerCharacteristicUUID = savedConfig, savedUUID }()
+
+	s, err := schema.Parse([]byte(`{"characteristic_mappings": {
+		"` + transmitPowerCharacteristicUUID.String() + `": {"name": "Transmit Power", "data_type": "int8", "editing": "selection", "selection_options": [-3, 0, 3]},
+		"` + responseTimeoutCharacteristicUUID.String() + `": {"name": "Response Timeout", "data_type": "uint8", "editing": "write", "range": [1, 100]}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := savedConfig
+	valid.TransmitPower, valid.ResponseTimeout = 3, 10
+
+	tests := []struct {
+		name   string
+		config func(*nvmConfigStruct)
+		want   string // Substring of the error, empty for none
+	}{
+		{"valid", func(*nvmConfigStruct) {}, ""},
+		{"not an option", func(c *nvmConfigStruct) { c.TransmitPower = 6 }, "defaults.transmit_power: 6"},
+		{"below range", func(c *nvmConfigStruct) { c.ResponseTimeout = 0 }, "defaults.response_timeout: 0"},
+		{"above range", func(c *nvmConfigStruct) { c.ResponseTimeout = 101 }, "defaults.response_timeout: 101"},
+		{"peripheral limit", func(c *nvmConfigStruct) { c.AutoDisconnectBit = 2 }, "defaults.auto_disconnect_bit: 2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			factoryConfig = valid
+			test.config(&factoryConfig)
+			err := validateAppliedConfig(peripheralConfigStruct{}, s)
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("error %v, want %q", err, test.want)
+			}
+		})
+	}
+
+	// The schema moving a characteristic onto a UUID already in use
+	factoryConfig = valid
+	transmitPowerCharacteristicUUID = responseTimeoutCharacteristicUUID
+	if err := validateAppliedConfig(peripheralConfigStruct{}, s); err == nil || !strings.Contains(err.Error(), "response_timeout and transmit_power share") {
+		t.Fatalf("error %v, want a shared UUID", err)
+	}
+}
+
+func TestValidateAppliedConfigRefusesSchemaUUIDOverrides(t *testing.T) {
+	s, err := schema.Parse([]byte(`{"characteristic_mappings": {
+		"` + transmitPowerCharacteristicUUID.String() + `": {"key": "transmit_power", "name": "Transmit Power", "data_type": "int8"}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := peripheralConfigStruct{UUIDs: map[string]string{"transmit_power": "00000000-0000-4000-8000-000000000001"}}
+	if err := validateAppliedConfig(config, s); err == nil || !strings.Contains(err.Error(), "uuids.transmit_power: set to") {
+		t.Fatalf("error %v, want the override refused", err)
+	}
+}
+
+func TestValidateDeviceInformation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*peripheralConfigStruct)
+		want   string // Substring of the error, empty for none
+	}{
+		{"built in", func(*peripheralConfigStruct) {}, ""},
+		{"longest", func(c *peripheralConfigStruct) { c.ModelNumber = strings.Repeat("m", maxAttributeLength) }, ""},
+		{"empty serial number", func(c *peripheralConfigStruct) { c.SerialNumber = "" }, "serial_number must be"},
+		{"empty manufacturer name", func(c *peripheralConfigStruct) { c.ManufacturerName = "" }, "manufacturer_name must be"},
+		{"too long", func(c *peripheralConfigStruct) { c.HardwareRevision = strings.Repeat("h", maxAttributeLength+1) }, "hardware_revision must be"},
+		{"too long firmware revision", func(c *peripheralConfigStruct) { c.FirmwareRevision = strings.Repeat("1", maxAttributeLength+1) }, "firmware_revision must be"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := builtinConfig()
+			test.config(&config)
+			err := config.validate()
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
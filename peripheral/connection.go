@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// A transfer without a confirm or stream control write for this long is abandoned
+const sensorDataTransferTimeout = 30 * time.Second
+
+// Call handler with the object path of every device BlueZ reports as
+// disconnected. tinygo only reports the connections it makes as a central,
+// centrals connecting to the peripheral are seen on org.bluez.Device1 alone.
+func watchDisconnects(handler func(device dbus.ObjectPath)) error {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	err = bus.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+		dbus.WithMatchArg(0, "org.bluez.Device1"),
+	)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan *dbus.Signal, 16)
+	bus.Signal(signals)
+	go func() {
+		for signal := range signals {
+			if signal.Name != "org.freedesktop.DBus.Properties.PropertiesChanged" || len(signal.Body) < 2 {
+				continue
+			}
+			if iface, _ := signal.Body[0].(string); iface != "org.bluez.Device1" {
+				continue
+			}
+			changes, _ := signal.Body[1].(map[string]dbus.Variant)
+			if connected, ok := changes["Connected"].Value().(bool); ok && !connected {
+				handler(signal.Path)
+			}
+		}
+	}()
+	return nil
+}
+
+func centralDisconnected(device dbus.ObjectPath) {
+	println("Central disconnected:", string(device))
+
+	serializedSensorDataMutex.Lock()
+	defer serializedSensorDataMutex.Unlock()
+
+	// The next central negotiates its own MTU
+	connectionMTU = 0
+	abandonSensorDataTransfer("the central disconnected")
+	writeSensorDataChunk()
+}
+
+// Abandon transfers the central stopped driving.
+func sensorDataTransferWatchdog() {
+	for {
+		time.Sleep(time.Second)
+
+		serializedSensorDataMutex.Lock()
+		if sensorDataInTransfer && time.Since(sensorDataTransferActivity) > sensorDataTransferTimeout {
+			abandonSensorDataTransfer("it timed out")
+		}
+		serializedSensorDataMutex.Unlock()
+	}
+}
+
+// End a transfer without deleting anything: stop the stream, merge the staged
+// sensor data into memory and offer the selection again from its first chunk.
+// Caller must hold serializedSensorDataMutex.
+func abandonSensorDataTransfer(reason string) {
+	if !sensorDataInTransfer {
+		return
+	}
+
+	println("Abandoning the sensor data transfer,", reason+".")
+	sensorDataInTransfer = false
+	flushSensorDataStaging()
+	startSensorDataTransfer()
+}
@@ -0,0 +1,181 @@
+// Package decode turns captured serializedSensorData and serializedDeviceLogData
+// byte streams back into typed records.
+package decode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"go-ble/record"
+)
+
+// Record is a single decoded record together with its position in the stream.
+// Exactly one of Sensor and Log is set.
+type Record struct {
+	Offset int
+	Size   int
+	record.Header
+	Sensor *record.Sensor
+	Log    *record.Log
+}
+
+var (
+	ErrTruncated = errors.New("truncated record")
+	ErrCorrupt   = errors.New("corrupted record")
+)
+
+// Error describes a damaged region of the stream. Length bytes starting at
+// Offset were skipped.
+type Error struct {
+	Offset int
+	Length int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("offset %d (+%d bytes): %v", e.Offset, e.Length, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Decoder iterates over the records of a stream.
+type Decoder struct {
+	data   []byte
+	offset int
+	record Record
+	err    *Error
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data: data}
+}
+
+// Next advances to the next record or damaged region. It returns false once
+// the stream is exhausted.
+func (d *Decoder) Next() bool {
+	d.record = Record{}
+	d.err = nil
+
+	if d.offset >= len(d.data) {
+		return false
+	}
+
+	rest := d.data[d.offset:]
+	frame, size, err := record.Decode(rest)
+	if err == nil {
+		d.record, err = typed(d.offset, size, frame)
+		if err == nil {
+			d.offset += size
+			return true
+		}
+		d.fail(size, err)
+		return true
+	}
+
+	// The header can't be trusted, its length field may be the damaged part:
+	// continue at the next intact frame.
+	next, intact := resync(rest)
+	switch {
+	case errors.Is(err, record.ErrShort) && intact:
+		d.fail(next, fmt.Errorf("%w: record %d claims %d payload bytes, the next intact record starts at offset %d",
+			ErrCorrupt, frame.ID, frame.Length, d.offset+next))
+	case errors.Is(err, record.ErrShort):
+		need := record.HeaderSize
+		if len(rest) >= record.HeaderSize {
+			need += int(frame.Length)
+		}
+		d.fail(len(rest), fmt.Errorf("%w: need %d bytes, have %d", ErrTruncated, need, len(rest)))
+	case errors.Is(err, record.ErrChecksum):
+		d.fail(next, fmt.Errorf("record %d: %w", frame.ID, err))
+	default:
+		d.fail(next, err)
+	}
+	return true
+}
+
+// Record returns the current record. It is only valid if Err returns nil.
+func (d *Decoder) Record() Record {
+	return d.record
+}
+
+// Err returns the damaged region the decoder stopped at, if any.
+func (d *Decoder) Err() *Error {
+	return d.err
+}
+
+func (d *Decoder) fail(length int, err error) {
+	d.err = &Error{Offset: d.offset, Length: length, Err: err}
+	d.offset += length
+}
+
+// All decodes the whole stream, returning every intact record and every
+// damaged region.
+func All(data []byte) ([]Record, []*Error) {
+	var records []Record
+	var errs []*Error
+
+	d := NewDecoder(data)
+	for d.Next() {
+		if err := d.Err(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		records = append(records, d.Record())
+	}
+	return records, errs
+}
+
+func typed(offset, size int, frame record.Frame) (Record, error) {
+	r := Record{Offset: offset, Size: size, Header: frame.Header}
+
+	switch frame.Type {
+	case record.TypeSensor:
+		s, err := frame.Sensor()
+		if err != nil {
+			return r, fmt.Errorf("record %d: %w", frame.ID, err)
+		}
+		r.Sensor = &s
+	case record.TypeLog:
+		l, err := frame.Log()
+		if err != nil {
+			return r, fmt.Errorf("record %d: %w", frame.ID, err)
+		}
+		r.Log = &l
+	default:
+		return r, fmt.Errorf("record %d: unknown %v", frame.ID, frame.Type)
+	}
+	return r, nil
+}
+
+// Returns the distance to the next frame start after the first byte: the next
+// magic that starts an intact frame, intact is then true. Without one it is the
+// next magic starting a valid header that runs past the end, the truncated
+// tail, or the end of b.
+func resync(b []byte) (next int, intact bool) {
+	var magic [2]byte
+	binary.LittleEndian.PutUint16(magic[:], record.Magic)
+
+	tail := len(b)
+	for i := 1; i < len(b); {
+		j := bytes.Index(b[i:], magic[:])
+		if j < 0 {
+			break
+		}
+		i += j
+		_, _, err := record.Decode(b[i:])
+		if err == nil {
+			return i, true
+		}
+		if errors.Is(err, record.ErrShort) && tail == len(b) {
+			if _, err := record.DecodeHeader(b[i:]); err == nil {
+				tail = i
+			}
+		}
+		i++
+	}
+	return tail, false
+}
@@ -0,0 +1,158 @@
+package decode
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"go-ble/record"
+)
+
+// Three records and the offsets they start at.
+func stream() ([]byte, []int) {
+	var data []byte
+	var offsets []int
+
+	offsets = append(offsets, len(data))
+	data = record.AppendSensor(data, 1, 0, record.Sensor{Timestamp: 100, TimeLength: 40, ODR: 2500, Samples: []byte{1, 0, 2, 0}})
+	offsets = append(offsets, len(data))
+	data = record.AppendLog(data, 2, 0, record.Log{Timestamp: 200, Message: "New sensor data received"})
+	offsets = append(offsets, len(data))
+	data = record.AppendSensor(data, 3, 0, record.Sensor{Timestamp: 300, TimeLength: 80, ODR: 2500, Samples: []byte{3, 0, 4, 0, 5, 0}})
+	return data, offsets
+}
+
+func TestAll(t *testing.T) {
+	clean, offsets := stream()
+	second := offsets[1]
+	secondSize := offsets[2] - offsets[1]
+
+	tests := []struct {
+		name   string
+		damage func([]byte) []byte
+		ids    []uint32
+		err    error
+		offset int
+		length int
+	}{
+		{
+			name:   "intact",
+			damage: func(b []byte) []byte { return b },
+			ids:    []uint32{1, 2, 3},
+		},
+		{
+			name:   "truncated tail",
+			damage: func(b []byte) []byte { return b[:len(b)-3] },
+			ids:    []uint32{1, 2},
+			err:    ErrTruncated,
+			offset: offsets[2],
+			length: len(clean) - 3 - offsets[2],
+		},
+		{
+			name: "bad checksum mid-stream",
+			damage: func(b []byte) []byte {
+				b[second+record.HeaderSize+12] ^= 0xff
+				return b
+			},
+			ids:    []uint32{1, 3},
+			err:    record.ErrChecksum,
+			offset: second,
+			length: secondSize,
+		},
+		{
+			name: "bad magic",
+			damage: func(b []byte) []byte {
+				b[second] = 0x00
+				return b
+			},
+			ids:    []uint32{1, 3},
+			err:    record.ErrMagic,
+			offset: second,
+			length: secondSize,
+		},
+		{
+			name: "length corrupted past the end",
+			damage: func(b []byte) []byte {
+				binary.LittleEndian.PutUint32(b[second+10:], 0x00ffffff)
+				return b
+			},
+			ids:    []uint32{1, 3},
+			err:    ErrCorrupt,
+			offset: second,
+			length: secondSize,
+		},
+		{
+			name: "length corrupted within the stream",
+			damage: func(b []byte) []byte {
+				binary.LittleEndian.PutUint32(b[second+10:], 4)
+				return b
+			},
+			ids:    []uint32{1, 3},
+			err:    record.ErrChecksum,
+			offset: second,
+			length: secondSize,
+		},
+		{
+			name: "garbage before a truncated tail",
+			damage: func(b []byte) []byte {
+				b[second] = 0x00
+				return b[:len(b)-3]
+			},
+			ids:    []uint32{1},
+			err:    record.ErrMagic,
+			offset: second,
+			length: secondSize,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.damage(append([]byte(nil), clean...))
+			records, errs := All(data)
+
+			var ids []uint32
+			for _, r := range records {
+				ids = append(ids, r.ID)
+			}
+			if len(ids) != len(tt.ids) {
+				t.Fatalf("records %v, want %v (errors %v)", ids, tt.ids, errs)
+			}
+			for i := range ids {
+				if ids[i] != tt.ids[i] {
+					t.Fatalf("records %v, want %v", ids, tt.ids)
+				}
+			}
+
+			if tt.err == nil {
+				if len(errs) != 0 {
+					t.Fatalf("unexpected errors %v", errs)
+				}
+				return
+			}
+			if len(errs) == 0 {
+				t.Fatalf("no error, want %v", tt.err)
+			}
+			err := errs[0]
+			if !errors.Is(err, tt.err) || err.Offset != tt.offset || err.Length != tt.length {
+				t.Fatalf("error %v at %d +%d, want %v at %d +%d", err.Err, err.Offset, err.Length, tt.err, tt.offset, tt.length)
+			}
+		})
+	}
+}
+
+func TestAllCoversStream(t *testing.T) {
+	clean, _ := stream()
+	data := append(append([]byte{0xde, 0xad}, clean...), 0x53, 0x4d, 0x01)
+
+	records, errs := All(data)
+	covered := 0
+	for _, r := range records {
+		covered += r.Size
+	}
+	for _, err := range errs {
+		covered += err.Length
+	}
+	if len(records) != 3 || covered != len(data) {
+		t.Fatalf("%d records, %d of %d bytes accounted for, errors %v", len(records), covered, len(data), errs)
+	}
+}
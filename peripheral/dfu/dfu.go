@@ -0,0 +1,227 @@
+// Package dfu implements a simulated firmware update target. An image is
+// announced with its size, CRC-32 and revision, uploaded in chunks, validated
+// against an Ed25519 signature and staged until the device reboots.
+//
+// Control point requests, the first byte is the opcode:
+//
+//	0x01 uint32 size, uint32 CRC-32, uint8 n, n bytes revision   start an upload
+//	0x02 64 byte signature                                       validate and stage the image
+//	0x03                                                         activate the staged image (reboot)
+//	0x04                                                         abort the upload
+//
+// Data writes carry a uint32 offset followed by the chunk. The signature covers
+// the revision, a zero byte and the image.
+package dfu
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const (
+	OpStart    byte = 0x01
+	OpValidate byte = 0x02
+	OpActivate byte = 0x03
+	OpAbort    byte = 0x04
+)
+
+// State of the update target.
+type State byte
+
+const (
+	StateIdle      State = 0x00
+	StateReceiving State = 0x01
+	StateStaged    State = 0x02
+	StateFailed    State = 0x03
+)
+
+// Result of the last request.
+type Result byte
+
+const (
+	ResultOK                Result = 0x00
+	ResultInvalidParameter  Result = 0x01
+	ResultInvalidState      Result = 0x02
+	ResultOffsetMismatch    Result = 0x03
+	ResultSizeMismatch      Result = 0x04
+	ResultChecksumMismatch  Result = 0x05
+	ResultSignatureMismatch Result = 0x06
+	ResultAborted           Result = 0x07
+)
+
+// Largest image the target accepts.
+const MaxImageSize = 0x40000
+
+// TestKey signs images for the simulated device. It is derived from a public
+// seed and must never protect a real device.
+var TestKey = ed25519.NewKeyFromSeed(testSeed())
+
+func testSeed() []byte {
+	seed := sha256.Sum256([]byte("MEMS_bluetooth DFU test key"))
+	return seed[:]
+}
+
+// Sign returns the signature of an image for the given revision.
+func Sign(key ed25519.PrivateKey, revision string, image []byte) []byte {
+	return ed25519.Sign(key, signedMessage(revision, image))
+}
+
+func signedMessage(revision string, image []byte) []byte {
+	message := append([]byte(revision), 0x00)
+	return append(message, image...)
+}
+
+// Image is a validated firmware image.
+type Image struct {
+	Revision string
+	Data     []byte
+}
+
+// Target receives and stages firmware images.
+type Target struct {
+	PublicKey ed25519.PublicKey
+
+	// Failure injection: abort the upload once AbortAt bytes are received
+	// (negative disables it), and corrupt the next received chunk.
+	AbortAt     int
+	CorruptNext bool
+
+	state    State
+	result   Result
+	size     int
+	crc      uint32
+	revision string
+	image    []byte
+	staged   *Image
+}
+
+func NewTarget(publicKey ed25519.PublicKey) *Target {
+	return &Target{PublicKey: publicKey, AbortAt: -1}
+}
+
+// Control executes a control point request. It returns the staged image when
+// the central asks to activate it.
+func (t *Target) Control(request []byte) (activate *Image) {
+	if len(request) == 0 {
+		t.result = ResultInvalidParameter
+		return nil
+	}
+
+	op, args := request[0], request[1:]
+	switch op {
+	case OpStart:
+		if len(args) < 9 || len(args) != 9+int(args[8]) {
+			t.result = ResultInvalidParameter
+			return nil
+		}
+		size := int(binary.LittleEndian.Uint32(args[0:4]))
+		if size == 0 || size > MaxImageSize {
+			t.result = ResultInvalidParameter
+			return nil
+		}
+		t.state = StateReceiving
+		t.result = ResultOK
+		t.size = size
+		t.crc = binary.LittleEndian.Uint32(args[4:8])
+		t.revision = string(args[9:])
+		t.image = make([]byte, 0, size)
+		t.staged = nil
+	case OpValidate:
+		if t.state != StateReceiving {
+			t.result = ResultInvalidState
+			return nil
+		}
+		if len(args) != ed25519.SignatureSize {
+			t.result = ResultInvalidParameter
+			return nil
+		}
+		switch {
+		case len(t.image) != t.size:
+			t.fail(ResultSizeMismatch)
+		case crc32.ChecksumIEEE(t.image) != t.crc:
+			t.fail(ResultChecksumMismatch)
+		case !ed25519.Verify(t.PublicKey, signedMessage(t.revision, t.image), args):
+			t.fail(ResultSignatureMismatch)
+		default:
+			t.state = StateStaged
+			t.result = ResultOK
+			t.staged = &Image{Revision: t.revision, Data: t.image}
+		}
+	case OpActivate:
+		if t.state != StateStaged || len(args) != 0 {
+			t.result = ResultInvalidState
+			return nil
+		}
+		activate = t.staged
+		t.reset()
+	case OpAbort:
+		t.fail(ResultAborted)
+	default:
+		t.result = ResultInvalidParameter
+	}
+	return activate
+}
+
+// Write receives a data chunk: uint32 offset followed by image bytes.
+func (t *Target) Write(chunk []byte) {
+	if t.state != StateReceiving {
+		t.result = ResultInvalidState
+		return
+	}
+	if len(chunk) < 5 {
+		t.result = ResultInvalidParameter
+		return
+	}
+
+	offset := int(binary.LittleEndian.Uint32(chunk[0:4]))
+	data := bytes.Clone(chunk[4:])
+	if offset != len(t.image) {
+		t.result = ResultOffsetMismatch
+		return
+	}
+	if offset+len(data) > t.size {
+		t.fail(ResultSizeMismatch)
+		return
+	}
+
+	if t.CorruptNext {
+		data[len(data)/2] ^= 0xff
+		t.CorruptNext = false
+	}
+
+	t.image = append(t.image, data...)
+	t.result = ResultOK
+
+	if t.AbortAt >= 0 && len(t.image) >= t.AbortAt {
+		t.AbortAt = -1
+		t.fail(ResultAborted)
+	}
+}
+
+// Status returns state, result and the uint32 count of received bytes.
+func (t *Target) Status() []byte {
+	status := []byte{byte(t.state), byte(t.result)}
+	return binary.LittleEndian.AppendUint32(status, uint32(len(t.image)))
+}
+
+// State returns the current state.
+func (t *Target) State() State {
+	return t.state
+}
+
+func (t *Target) fail(result Result) {
+	t.state = StateFailed
+	t.result = result
+	t.image = nil
+	t.staged = nil
+}
+
+func (t *Target) reset() {
+	t.state = StateIdle
+	t.result = ResultOK
+	t.image = nil
+	t.staged = nil
+}
@@ -0,0 +1,178 @@
+package dfu
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+const testRevision = "1.2.3"
+
+var testImage = bytes.Repeat([]byte("firmware"), 100)
+
+func startRequest(size int, crc uint32, revision string) []byte {
+	request := binary.LittleEndian.AppendUint32([]byte{OpStart}, uint32(size))
+	request = binary.LittleEndian.AppendUint32(request, crc)
+	request = append(request, byte(len(revision)))
+	return append(request, revision...)
+}
+
+func dataChunk(offset int, data []byte) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(offset)), data...)
+}
+
+// Announce and upload image in chunks of 64 bytes.
+func upload(target *Target, image []byte, crc uint32) {
+	target.Control(startRequest(len(image), crc, testRevision))
+	for offset := 0; offset < len(image); offset += 64 {
+		target.Write(dataChunk(offset, image[offset:min(offset+64, len(image))]))
+	}
+}
+
+func validateRequest(signature []byte) []byte {
+	return append([]byte{OpValidate}, signature...)
+}
+
+func expect(t *testing.T, target *Target, state State, result Result, received int) {
+	t.Helper()
+	want := binary.LittleEndian.AppendUint32([]byte{byte(state), byte(result)}, uint32(received))
+	if status := target.Status(); !bytes.Equal(status, want) {
+		t.Fatalf("status % x, want % x", status, want)
+	}
+}
+
+func TestValidImage(t *testing.T) {
+	target := NewTarget(TestKey.Public().(ed25519.PublicKey))
+	upload(target, testImage, crc32.ChecksumIEEE(testImage))
+	expect(t, target, StateReceiving, ResultOK, len(testImage))
+
+	target.Control(validateRequest(Sign(TestKey, testRevision, testImage)))
+	expect(t, target, StateStaged, ResultOK, len(testImage))
+
+	image := target.Control([]byte{OpActivate})
+	if image == nil || image.Revision != testRevision || !bytes.Equal(image.Data, testImage) {
+		t.Fatalf("activated %+v", image)
+	}
+	expect(t, target, StateIdle, ResultOK, 0)
+
+	// Nothing is staged any more
+	if image := target.Control([]byte{OpActivate}); image != nil {
+		t.Fatal("activated the image twice")
+	}
+	expect(t, target, StateIdle, ResultInvalidState, 0)
+}
+
+func TestFailures(t *testing.T) {
+	otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+	crc := crc32.ChecksumIEEE(testImage)
+
+	tests := []struct {
+		name   string
+		run    func(target *Target)
+		state  State
+		result Result
+	}{
+		{"signature of another key", func(target *Target) {
+			upload(target, testImage, crc)
+			target.Control(validateRequest(Sign(otherKey, testRevision, testImage)))
+		}, StateFailed, ResultSignatureMismatch},
+		{"signature of another revision", func(target *Target) {
+			upload(target, testImage, crc)
+			target.Control(validateRequest(Sign(TestKey, "9.9.9", testImage)))
+		}, StateFailed, ResultSignatureMismatch},
+		{"truncated signature", func(target *Target) {
+			upload(target, testImage, crc)
+			target.Control(validateRequest(Sign(TestKey, testRevision, testImage)[:32]))
+		}, StateReceiving, ResultInvalidParameter},
+		{"announced CRC mismatch", func(target *Target) {
+			upload(target, testImage, crc^1)
+			target.Control(validateRequest(Sign(TestKey, testRevision, testImage)))
+		}, StateFailed, ResultChecksumMismatch},
+		{"chunk corrupted in transit", func(target *Target) {
+			target.CorruptNext = true
+			upload(target, testImage, crc)
+			target.Control(validateRequest(Sign(TestKey, testRevision, testImage)))
+		}, StateFailed, ResultChecksumMismatch},
+		{"image larger than the target takes", func(target *Target) {
+			target.Control(startRequest(MaxImageSize+1, 0, testRevision))
+		}, StateIdle, ResultInvalidParameter},
+		{"empty image", func(target *Target) {
+			target.Control(startRequest(0, 0, testRevision))
+		}, StateIdle, ResultInvalidParameter},
+		{"data past the announced size", func(target *Target) {
+			target.Control(startRequest(10, crc, testRevision))
+			target.Write(dataChunk(0, testImage[:11]))
+		}, StateFailed, ResultSizeMismatch},
+		{"validated before the image is complete", func(target *Target) {
+			target.Control(startRequest(len(testImage), crc, testRevision))
+			target.Write(dataChunk(0, testImage[:64]))
+			target.Control(validateRequest(Sign(TestKey, testRevision, testImage)))
+		}, StateFailed, ResultSizeMismatch},
+		{"chunk at the wrong offset", func(target *Target) {
+			target.Control(startRequest(len(testImage), crc, testRevision))
+			target.Write(dataChunk(0, testImage[:64]))
+			target.Write(dataChunk(128, testImage[128:192]))
+		}, StateReceiving, ResultOffsetMismatch},
+		{"start with a truncated revision", func(target *Target) {
+			target.Control(startRequest(len(testImage), crc, testRevision)[:12])
+		}, StateIdle, ResultInvalidParameter},
+		{"validate without an upload", func(target *Target) {
+			target.Control(validateRequest(Sign(TestKey, testRevision, testImage)))
+		}, StateIdle, ResultInvalidState},
+		{"unknown opcode", func(target *Target) {
+			target.Control([]byte{0x7f})
+		}, StateIdle, ResultInvalidParameter},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := NewTarget(TestKey.Public().(ed25519.PublicKey))
+			tt.run(target)
+
+			if target.State() != tt.state || Result(target.Status()[1]) != tt.result {
+				t.Fatalf("state 0x%02x result 0x%02x, want 0x%02x 0x%02x", target.State(), target.Status()[1], tt.state, tt.result)
+			}
+			// A failed upload keeps nothing to activate
+			if image := target.Control([]byte{OpActivate}); image != nil {
+				t.Fatalf("activated %+v", image)
+			}
+		})
+	}
+}
+
+func TestAbortMidUpload(t *testing.T) {
+	target := NewTarget(TestKey.Public().(ed25519.PublicKey))
+	target.Control(startRequest(len(testImage), crc32.ChecksumIEEE(testImage), testRevision))
+	target.Write(dataChunk(0, testImage[:64]))
+	expect(t, target, StateReceiving, ResultOK, 64)
+
+	target.Control([]byte{OpAbort})
+	expect(t, target, StateFailed, ResultAborted, 0)
+
+	// The rest of the upload is refused
+	target.Write(dataChunk(64, testImage[64:128]))
+	expect(t, target, StateFailed, ResultInvalidState, 0)
+	target.Control(validateRequest(Sign(TestKey, testRevision, testImage)))
+	expect(t, target, StateFailed, ResultInvalidState, 0)
+
+	// A new upload starts from scratch
+	upload(target, testImage, crc32.ChecksumIEEE(testImage))
+	target.Control(validateRequest(Sign(TestKey, testRevision, testImage)))
+	expect(t, target, StateStaged, ResultOK, len(testImage))
+}
+
+func TestAbortInjection(t *testing.T) {
+	target := NewTarget(TestKey.Public().(ed25519.PublicKey))
+	target.AbortAt = 100
+	upload(target, testImage, crc32.ChecksumIEEE(testImage))
+	expect(t, target, StateFailed, ResultInvalidState, 0)
+
+	// Injection fires once
+	if target.AbortAt != -1 {
+		t.Fatalf("AbortAt %d after firing", target.AbortAt)
+	}
+	upload(target, testImage, crc32.ChecksumIEEE(testImage))
+	expect(t, target, StateReceiving, ResultOK, len(testImage))
+}
@@ -0,0 +1,213 @@
+// Package export converts decoded sensor records into formats analysts can
+// open directly: WAV audio, CSV and NumPy .npy arrays with a JSON sidecar.
+package export
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go-ble/record"
+)
+
+// Supported output formats.
+const (
+	FormatWAV = "wav"
+	FormatCSV = "csv"
+	FormatNPY = "npy"
+)
+
+var Formats = []string{FormatWAV, FormatCSV, FormatNPY}
+
+var ErrNoODR = errors.New("export: record has no sample rate")
+
+// Metadata is written next to every .npy file.
+type Metadata struct {
+	RecordID    uint32 `json:"record_id"`
+	Timestamp   int64  `json:"timestamp_us"`
+	TimeLength  uint32 `json:"time_length_us"`
+	ODR         uint16 `json:"odr_hz"`
+	Samples     int    `json:"samples"`
+	SampleWidth int    `json:"sample_width"`
+	DType       string `json:"dtype"`
+}
+
+// WAV writes the samples as a mono 16 bit PCM file sampled at the record ODR.
+// The mean of the record is subtracted, an accelerometer at rest reads about
+// 1 g and would otherwise play as a step that clips. A PCM step is one sensor
+// count, values are clamped to the int16 range. CSV and NPY keep the raw
+// samples.
+func WAV(w io.Writer, s record.Sensor) error {
+	if s.ODR == 0 {
+		return ErrNoODR
+	}
+	values := s.Values()
+	dataSize := uint32(len(values) * record.SampleWidth)
+	blockAlign := uint16(record.SampleWidth)
+
+	header := make([]byte, 44)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], 36+dataSize)
+	copy(header[8:12], "WAVE")
+	copy(header[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16) // PCM fmt chunk size
+	binary.LittleEndian.PutUint16(header[20:22], 1)  // PCM
+	binary.LittleEndian.PutUint16(header[22:24], 1)  // Mono
+	binary.LittleEndian.PutUint32(header[24:28], uint32(s.ODR))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(s.ODR)*uint32(blockAlign))
+	binary.LittleEndian.PutUint16(header[32:34], blockAlign)
+	binary.LittleEndian.PutUint16(header[34:36], uint16(record.SampleWidth*8))
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], dataSize)
+
+	var sum int
+	for _, v := range values {
+		sum += int(v)
+	}
+	mean := 0
+	if len(values) > 0 {
+		mean = int(math.Round(float64(sum) / float64(len(values))))
+	}
+
+	data := make([]byte, dataSize)
+	for i, v := range values {
+		pcm := min(max(int(v)-mean, math.MinInt16), math.MaxInt16)
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(int16(pcm)))
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// CSV writes one row per sample with its absolute timestamp in microseconds.
+// The header row is written only if header is true, so several records can
+// share a file.
+func CSV(w io.Writer, id uint32, s record.Sensor, header bool) error {
+	if s.ODR == 0 {
+		return ErrNoODR
+	}
+	writer := csv.NewWriter(w)
+	if header {
+		writer.Write([]string{"record_id", "sample", "timestamp_us", "value"})
+	}
+	for i, v := range s.Values() {
+		timestamp := s.Timestamp + int64(i)*1_000_000/int64(s.ODR)
+		writer.Write([]string{
+			strconv.FormatUint(uint64(id), 10),
+			strconv.Itoa(i),
+			strconv.FormatInt(timestamp, 10),
+			strconv.FormatUint(uint64(v), 10),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// NPY writes the samples as a one dimensional little endian uint16 array in
+// NumPy format version 1.0.
+func NPY(w io.Writer, s record.Sensor) error {
+	values := s.Values()
+
+	dict := fmt.Sprintf("{'descr': '<u2', 'fortran_order': False, 'shape': (%d,), }", len(values))
+	padding := npyPadding(len(dict))
+	headerLength := len(dict) + padding + 1
+
+	header := make([]byte, 0, 10+headerLength)
+	header = append(header, "\x93NUMPY\x01\x00"...)
+	header = binary.LittleEndian.AppendUint16(header, uint16(headerLength))
+	header = append(header, dict...)
+	for range padding {
+		header = append(header, ' ')
+	}
+	header = append(header, '\n')
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	data := make([]byte, 0, len(values)*2)
+	for _, v := range values {
+		data = binary.LittleEndian.AppendUint16(data, v)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Magic, version and header length take 10 bytes. The header is padded with
+// spaces and terminated by a newline so the data starts 64 byte aligned.
+func npyPadding(dictLength int) int {
+	return (64 - (10+dictLength+1)%64) % 64
+}
+
+// Meta returns the sidecar metadata of a record.
+func Meta(id uint32, s record.Sensor) Metadata {
+	return Metadata{
+		RecordID:    id,
+		Timestamp:   s.Timestamp,
+		TimeLength:  s.TimeLength,
+		ODR:         s.ODR,
+		Samples:     len(s.Values()),
+		SampleWidth: record.SampleWidth,
+		DType:       "<u2",
+	}
+}
+
+// WriteFiles exports a record into dir as record_<id>.<format> for every
+// requested format, plus record_<id>.json alongside the .npy file. It returns
+// the paths written.
+func WriteFiles(dir string, id uint32, s record.Sensor, formats []string) ([]string, error) {
+	var written []string
+	base := filepath.Join(dir, fmt.Sprintf("record_%d", id))
+
+	create := func(ext string, write func(io.Writer) error) error {
+		path := base + "." + ext
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := write(file); err != nil {
+			file.Close()
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		written = append(written, path)
+		return nil
+	}
+
+	for _, format := range formats {
+		var err error
+		switch format {
+		case FormatWAV:
+			err = create("wav", func(w io.Writer) error { return WAV(w, s) })
+		case FormatCSV:
+			err = create("csv", func(w io.Writer) error { return CSV(w, id, s, true) })
+		case FormatNPY:
+			err = create("npy", func(w io.Writer) error { return NPY(w, s) })
+			if err == nil {
+				err = create("json", func(w io.Writer) error {
+					encoder := json.NewEncoder(w)
+					encoder.SetIndent("", "  ")
+					encoder.SetEscapeHTML(false)
+					return encoder.Encode(Meta(id, s))
+				})
+			}
+		default:
+			err = fmt.Errorf("export: unknown format %q", format)
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
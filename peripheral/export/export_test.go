@@ -0,0 +1,119 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-ble/record"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+var goldenSensor = record.Sensor{
+	Timestamp:  1_730_000_000_123_456,
+	TimeLength: 1200,
+	ODR:        2500,
+	Samples:    []byte{0x01, 0x02, 0xff, 0x03, 0x10, 0x00},
+}
+
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s mismatch\n got: % x\nwant: % x", name, got, want)
+	}
+}
+
+func TestGolden(t *testing.T) {
+	var npy, wav, csv bytes.Buffer
+	if err := NPY(&npy, goldenSensor); err != nil {
+		t.Fatal(err)
+	}
+	if err := WAV(&wav, goldenSensor); err != nil {
+		t.Fatal(err)
+	}
+	if err := CSV(&csv, 7, goldenSensor, true); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "record.npy", npy.Bytes())
+	golden(t, "record.wav", wav.Bytes())
+	golden(t, "record.csv", csv.Bytes())
+}
+
+func TestNPYAlignment(t *testing.T) {
+	for _, samples := range []int{0, 1, 3, 10, 1_000, 100_000} {
+		var b bytes.Buffer
+		if err := NPY(&b, record.Sensor{ODR: 2500, Samples: make([]byte, samples*record.SampleWidth)}); err != nil {
+			t.Fatal(err)
+		}
+		data := b.Bytes()
+		headerLength := int(binary.LittleEndian.Uint16(data[8:10]))
+		if (10+headerLength)%64 != 0 || data[10+headerLength-1] != '\n' {
+			t.Fatalf("%d samples: header of %d bytes isn't 64 byte aligned", samples, headerLength)
+		}
+		if len(data)-10-headerLength != samples*record.SampleWidth {
+			t.Fatalf("%d samples: %d data bytes", samples, len(data)-10-headerLength)
+		}
+	}
+}
+
+func TestNPYPadding(t *testing.T) {
+	tests := []struct {
+		dictLength int
+		padding    int
+	}{
+		{53, 0}, // Already aligned: no padding, not a full line of it
+		{54, 63},
+		{52, 1},
+		{117, 0},
+	}
+	for _, tt := range tests {
+		if got := npyPadding(tt.dictLength); got != tt.padding {
+			t.Errorf("npyPadding(%d) = %d, want %d", tt.dictLength, got, tt.padding)
+		}
+	}
+}
+
+func TestWAVRemovesDC(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []uint16
+		pcm     []int16
+	}{
+		{"at rest", []uint16{16384, 16384, 16384}, []int16{0, 0, 0}},
+		{"around the offset", []uint16{16380, 16384, 16388}, []int16{-4, 0, 4}},
+		{"clamped", []uint16{0, 65535}, []int16{math.MinInt16, math.MaxInt16}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := record.Sensor{ODR: 2500}
+			for _, v := range test.samples {
+				s.Samples = binary.LittleEndian.AppendUint16(s.Samples, v)
+			}
+			var b bytes.Buffer
+			if err := WAV(&b, s); err != nil {
+				t.Fatal(err)
+			}
+			data := b.Bytes()[44:]
+			for i, want := range test.pcm {
+				if got := int16(binary.LittleEndian.Uint16(data[i*2:])); got != want {
+					t.Errorf("sample %d: %d, want %d", i, got, want)
+				}
+			}
+		})
+	}
+}
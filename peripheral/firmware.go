@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go-ble/dfu"
+)
+
+// Simulated firmware update target, accepting images signed with the test key
+var (
+	dfuTarget = newDFUTarget()
+	dfuMutex  sync.Mutex
+)
+
+func newDFUTarget() *dfu.Target {
+	return dfu.NewTarget(dfu.TestKey.Public().(ed25519.PublicKey))
+}
+
+// Publish the update state after a request. Caller must hold dfuMutex.
+func publishDFUStatus() {
+	selfWritingDFUStatus = true
+	dfuStatusHandle.Write(dfuTarget.Status())
+	selfWritingDFUStatus = false
+}
+
+// Persist a validated firmware image and reboot into it.
+func activateFirmware(image *dfu.Image) {
+	println("Activating firmware", image.Revision, "with", len(image.Data), "bytes...")
+
+	updateNVM(func(nvm *nvmStruct) {
+		nvm.FirmwareRevision = image.Revision
+	})
+
+	requestReboot(resetReasonFirmwareUpdate)
+}
+
+// Console failure injection: "dfu abort <bytes>", "dfu corrupt" or "dfu clear".
+func dfuFailureInjection(command string) {
+	dfuMutex.Lock()
+	defer dfuMutex.Unlock()
+
+	fields := strings.Fields(command)
+	switch {
+	case len(fields) == 2 && fields[0] == "abort":
+		bytes, err := strconv.Atoi(fields[1])
+		if err != nil || bytes < 0 {
+			println("Bad DFU abort offset:", fields[1])
+			return
+		}
+		dfuTarget.AbortAt = bytes
+		println("DFU upload will abort after", bytes, "bytes.")
+	case len(fields) == 1 && fields[0] == "corrupt":
+		dfuTarget.CorruptNext = true
+		println("Next DFU chunk will be corrupted.")
+	case len(fields) == 1 && fields[0] == "clear":
+		dfuTarget.AbortAt = -1
+		dfuTarget.CorruptNext = false
+		println("DFU failure injection cleared.")
+	default:
+		println("Usage: dfu abort <bytes> | dfu corrupt | dfu clear")
+	}
+}
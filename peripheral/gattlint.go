@@ -0,0 +1,251 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"go-ble/schema"
+
+	"github.com/google/uuid"
+	"tinygo.org/x/bluetooth"
+)
+
+// Variables holding the values of characteristics, by the UUID variable of the
+// characteristic. Their Go types are checked against the schema data types.
+var characteristicVariables = map[*bluetooth.UUID]any{
+	&bluetooth.CharacteristicUUIDDeviceName:      &deviceName,
+	&fwRevisionUUID:                              &fwRevision,
+	&batteryPercentageUUID:                       &batteryPercentage,
+	&deviceLogCharacteristicUUID:                 &serializedDeviceLogData,
+	&deviceLogLengthCharacteristicUUID:           &deviceLogLength,
+	&unixTimeSyncCharacteristicUUID:              &unixTimeSync,
+	&memoryAllocatedPercentageCharacteristicUUID: &memoryAllocatedPercentage,
+	&sensorDataClearBitCharacteristicUUID:        &sensorDataClearBit,
+	&autoDisconnectBitCharacteristicUUID:         &autoDisconnectBit,
+	&sensorODRCharacteristicUUID:                 &sensorODR,
+	&sensorDataCharacteristicUUID:                &serializedSensorData,
+	&sensorDataTotalCharacteristicUUID:           &sensorDataTotal,
+	&transmitPowerCharacteristicUUID:             &transmitPower,
+	&advIntervalGlobalCharacteristicUUID:         &advIntervalGlobal,
+	&advDurationCharacteristicUUID:               &advDuration,
+	&advIntervalLocalCharacteristicUUID:          &advIntervalLocal,
+	&responseTimeoutCharacteristicUUID:           &responseTimeout,
+	&bootCountCharacteristicUUID:                 &bootCount,
+	&lastResetReasonCharacteristicUUID:           &lastResetReason,
+	&configGenerationCharacteristicUUID:          &configGeneration,
+	&configChangedAtCharacteristicUUID:           &configChangedAt,
+}
+
+// characteristicVariables keyed by the current UUIDs.
+func characteristicVariablesByUUID() map[bluetooth.UUID]any {
+	variables := map[bluetooth.UUID]any{}
+	for id, variable := range characteristicVariables {
+		variables[*id] = variable
+	}
+	return variables
+}
+
+// Characteristics the app writes as a step of a procedure, such as the end of
+// a transfer, rather than offering them for editing
+var procedureWrites = []*bluetooth.UUID{
+	&confirmReadUUID,
+	&sensorDataClearBitCharacteristicUUID,
+	&unixTimeSyncCharacteristicUUID,
+	&configTransactionCharacteristicUUID,
+	&sensorDataStreamControlCharacteristicUUID,
+	&sensorDataAckCharacteristicUUID,
+}
+
+type lintFinding struct {
+	severity string // "error" or "warning"
+	uuid     string
+	name     string
+	message  string
+}
+
+// Storage of a characteristic value on the peripheral side.
+type lintStorage struct {
+	description string
+	integer     bool
+	size        int // Bytes, 0 for variable length
+	signed      bool
+}
+
+func (storage lintStorage) bounds() (lower, upper float64) {
+	bits := float64(8 * storage.size)
+	if storage.signed {
+		return -math.Exp2(bits - 1), math.Exp2(bits-1) - 1
+	}
+	return 0, math.Exp2(bits) - 1
+}
+
+// Describe how a characteristic stores its value: the Go type of its variable
+// if it has one, otherwise the length of its initial value.
+func characteristicStorage(c bluetooth.CharacteristicConfig, variables map[bluetooth.UUID]any) lintStorage {
+	variable, ok := variables[c.UUID]
+	if !ok {
+		return lintStorage{description: fmt.Sprintf("%d byte value", len(c.Value)), integer: len(c.Value) <= 8, size: len(c.Value)}
+	}
+
+	t := reflect.TypeOf(variable).Elem()
+	storage := lintStorage{description: t.String()}
+	switch t.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		storage.integer, storage.size = true, int(t.Size())
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		storage.integer, storage.size, storage.signed = true, int(t.Size()), true
+	}
+	return storage
+}
+
+// Check a characteristic the peripheral defines against its schema mapping:
+// the data type, ranges and selection options must fit the stored value and
+// editing needs write permission.
+func lintCharacteristic(mapping schema.Characteristic, c bluetooth.CharacteristicConfig, variables map[bluetooth.UUID]any) []lintFinding {
+	var findings []lintFinding
+	report := func(severity, format string, args ...any) {
+		findings = append(findings, lintFinding{severity, mapping.UUID, mapping.Name, fmt.Sprintf(format, args...)})
+	}
+
+	storage := characteristicStorage(c, variables)
+
+	switch {
+	case mapping.DataType == schema.String || mapping.DataType == schema.Bytes:
+		if storage.integer && variables[c.UUID] != nil {
+			report("error", "type mismatch, declared %s but stored as %s", mapping.DataType, storage.description)
+		}
+	case !storage.integer || storage.size != mapping.DataType.Size():
+		report("error", "type width mismatch, declared %s but stored as %s", mapping.DataType, storage.description)
+	case storage.signed != mapping.DataType.Signed():
+		report("error", "signedness mismatch, declared %s but stored as %s", mapping.DataType, storage.description)
+	}
+
+	if storage.integer && storage.size > 0 {
+		lower, upper := storage.bounds()
+		if len(mapping.Range) == 2 && (mapping.Range[0] < lower || mapping.Range[1] > upper) {
+			report("error", "range %v doesn't fit in %s [%v, %v]", mapping.Range, storage.description, lower, upper)
+		}
+		for _, option := range mapping.SelectionOptions {
+			if option < lower || option > upper {
+				report("error", "selection option %v doesn't fit in %s [%v, %v]", option, storage.description, lower, upper)
+			}
+		}
+	}
+
+	writable := c.Flags&(bluetooth.CharacteristicWritePermission|bluetooth.CharacteristicWriteWithoutResponsePermission) != 0
+	switch {
+	case mapping.Writable() && !writable:
+		report("error", "editing is %q but the characteristic isn't writable", mapping.Editing)
+	case !mapping.Writable() && writable && !slices.ContainsFunc(procedureWrites, func(id *bluetooth.UUID) bool { return *id == c.UUID }):
+		report("warning", "writable, but the schema offers no editing")
+	}
+	if c.Flags&bluetooth.CharacteristicReadPermission == 0 {
+		report("warning", "not readable, the app skips it when matching metadata")
+	}
+	return findings
+}
+
+// Compare the GATT stack the peripheral defines with the schema.
+func lintGATT(stack []bluetooth.Service, s *schema.Schema) []lintFinding {
+	var findings []lintFinding
+	report := func(severity, id, name, format string, args ...any) {
+		findings = append(findings, lintFinding{severity, id, name, fmt.Sprintf(format, args...)})
+	}
+
+	variables := characteristicVariablesByUUID()
+
+	defined := map[bluetooth.UUID]bluetooth.CharacteristicConfig{}
+	for _, service := range stack {
+		for _, c := range service.Characteristics {
+			defined[c.UUID] = c
+		}
+	}
+
+	described := map[bluetooth.UUID]bool{}
+	for _, mapping := range s.Characteristics {
+		id := bluetooth.NewUUID(uuid.MustParse(mapping.UUID))
+		if mapping.Key != "" {
+			target, ok := configurableUUIDs[mapping.Key]
+			if !ok {
+				report("error", mapping.UUID, mapping.Name, "key %q names no peripheral characteristic", mapping.Key)
+				continue
+			}
+			described[*target] = true
+			if *target != id {
+				report("error", mapping.UUID, mapping.Name, "mismatched UUID, the peripheral defines %s as %s", mapping.Key, target.String())
+				id = *target
+			}
+		}
+		described[id] = true
+
+		c, ok := defined[id]
+		if !ok {
+			report("error", mapping.UUID, mapping.Name, "missing, the peripheral doesn't define it")
+			continue
+		}
+		findings = append(findings, lintCharacteristic(mapping, c, variables)...)
+	}
+
+	// The app looks up the metadata of every characteristic it reads
+	for _, service := range stack {
+		for _, c := range service.Characteristics {
+			switch {
+			case described[c.UUID]:
+			case c.Flags&bluetooth.CharacteristicReadPermission != 0:
+				report("error", c.UUID.String(), "", "not described by the schema, but the app reads it")
+			default:
+				report("warning", c.UUID.String(), "", "not described by the schema")
+			}
+		}
+	}
+
+	slices.SortStableFunc(findings, func(a, b lintFinding) int {
+		if a.severity != b.severity {
+			return strings.Compare(a.severity, b.severity)
+		}
+		return strings.Compare(a.uuid, b.uuid)
+	})
+	return findings
+}
+
+// The gatt-lint command: go run . gatt-lint [-schema path]. Exits with status 1
+// when the schema and the peripheral disagree.
+func runGATTLint(args []string) int {
+	flags := flag.NewFlagSet("gatt-lint", flag.ContinueOnError)
+	schemaPath := flags.String("schema", defaultSchemaPath, "characteristic schema shared with the app")
+	warnings := flags.Bool("warnings", true, "report warnings")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	s, err := schema.Load(*schemaPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gatt-lint:", err)
+		return 1
+	}
+
+	errors := 0
+	for _, finding := range lintGATT(newGATTStack(), s) {
+		if finding.severity == "error" {
+			errors++
+		} else if !*warnings {
+			continue
+		}
+		name := ""
+		if finding.name != "" {
+			name = " (" + finding.name + ")"
+		}
+		fmt.Printf("%s: %s%s: %s\n", finding.severity, finding.uuid, name, finding.message)
+	}
+
+	if errors > 0 {
+		fmt.Printf("%d errors\n", errors)
+		return 1
+	}
+	return 0
+}
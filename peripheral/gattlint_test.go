@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"go-ble/schema"
+
+	"tinygo.org/x/bluetooth"
+)
+
+func TestLintGATT(t *testing.T) {
+	read := bluetooth.CharacteristicReadPermission
+	write := bluetooth.CharacteristicWritePermission
+	stack := []bluetooth.Service{{
+		UUID: bluetooth.New16BitUUID(0x1111),
+		Characteristics: []bluetooth.CharacteristicConfig{
+			{UUID: transmitPowerCharacteristicUUID, Value: ToByteArray(transmitPower), Flags: read | write},
+			{UUID: bootCountCharacteristicUUID, Value: ToByteArray(bootCount), Flags: read},
+			{UUID: confirmReadUUID, Value: []byte{0}, Flags: write},
+			{UUID: factoryResetCharacteristicUUID, Value: []byte{0}, Flags: write},
+		},
+	}}
+
+	transmitPowerMapping := `"` + transmitPowerCharacteristicUUID.String() + `": {"key": "transmit_power", "name": "TX", "data_type": "int8", "editing": "selection", "selection_options": [0, 3]}`
+	bootCountMapping := `"` + bootCountCharacteristicUUID.String() + `": {"name": "Boots", "data_type": "uint32"}`
+	confirmMapping := `"` + confirmReadUUID.String() + `": {"name": "Confirm", "data_type": "bool"}`
+	other := "0000abcd-0000-1000-8000-00805f9b34fb"
+
+	tests := []struct {
+		name     string
+		mappings []string
+		want     []string // "severity uuid: message", in order
+	}{
+		{
+			"clean",
+			[]string{transmitPowerMapping, bootCountMapping, confirmMapping},
+			[]string{
+				"warning " + confirmReadUUID.String() + ": not readable, the app skips it when matching metadata",
+				"warning " + factoryResetCharacteristicUUID.String() + ": not described by the schema",
+			},
+		},
+		{
+			"readable undescribed",
+			[]string{transmitPowerMapping, confirmMapping},
+			[]string{
+				"error " + bootCountCharacteristicUUID.String() + ": not described by the schema, but the app reads it",
+				"warning " + confirmReadUUID.String() + ": not readable, the app skips it when matching metadata",
+				"warning " + factoryResetCharacteristicUUID.String() + ": not described by the schema",
+			},
+		},
+		{
+			"missing",
+			[]string{`"` + other + `": {"name": "Other", "data_type": "uint8"}`},
+			[]string{"error " + other + ": missing, the peripheral doesn't define it"},
+		},
+		{
+			"unknown key",
+			[]string{`"` + other + `": {"key": "nonexistent", "name": "Other", "data_type": "uint8"}`},
+			[]string{`error ` + other + `: key "nonexistent" names no peripheral characteristic`},
+		},
+		{
+			"mismatched UUID",
+			[]string{`"` + other + `": {"key": "transmit_power", "name": "TX", "data_type": "int8", "editing": "selection", "selection_options": [0]}`},
+			[]string{"error " + other + ": mismatched UUID, the peripheral defines transmit_power as " + transmitPowerCharacteristicUUID.String()},
+		},
+		{
+			"width",
+			[]string{`"` + bootCountCharacteristicUUID.String() + `": {"name": "Boots", "data_type": "uint16"}`},
+			[]string{"error " + bootCountCharacteristicUUID.String() + ": type width mismatch, declared uint16 but stored as uint32"},
+		},
+		{
+			"signedness",
+			[]string{`"` + bootCountCharacteristicUUID.String() + `": {"name": "Boots", "data_type": "int32"}`},
+			[]string{"error " + bootCountCharacteristicUUID.String() + ": signedness mismatch, declared int32 but stored as uint32"},
+		},
+		{
+			"editing without write permission",
+			[]string{`"` + bootCountCharacteristicUUID.String() + `": {"name": "Boots", "data_type": "uint32", "editing": "write", "range": [0, 10]}`},
+			[]string{`error ` + bootCountCharacteristicUUID.String() + `: editing is "write" but the characteristic isn't writable`},
+		},
+		{
+			"writable without editing",
+			[]string{`"` + transmitPowerCharacteristicUUID.String() + `": {"name": "TX", "data_type": "int8"}`},
+			[]string{"warning " + transmitPowerCharacteristicUUID.String() + ": writable, but the schema offers no editing"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := schema.Parse([]byte(`{"characteristic_mappings": {` + strings.Join(test.mappings, ",") + `}}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, finding := range lintGATT(stack, s) {
+				if test.name != "clean" && test.name != "readable undescribed" && strings.HasPrefix(finding.message, "not described by the schema") {
+					continue
+				}
+				got = append(got, fmt.Sprintf("%s %s: %s", finding.severity, finding.uuid, finding.message))
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("findings:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestLintGATTRepoSchema(t *testing.T) {
+	s, err := schema.Load(defaultSchemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, finding := range lintGATT(newGATTStack(), s) {
+		if finding.severity == "error" {
+			t.Errorf("%s (%s): %s", finding.uuid, finding.name, finding.message)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"go-ble/schema"
+
+	"github.com/google/uuid"
+	"tinygo.org/x/bluetooth"
+)
+
+// Description of the characteristics the schema covers, by UUID
+var characteristicSchema = map[bluetooth.UUID]schema.Characteristic{}
+
+// Name and data type of the characteristics the schema leaves out, by the UUID
+// variable of the characteristic. The app doesn't read them, they only provide
+// the descriptors; writes are still checked against the peripheral's rules alone.
+var undescribedCharacteristics = map[*bluetooth.UUID]schema.Characteristic{
+	&rebootCharacteristicUUID:                             {Name: "Reboot", DataType: schema.Uint8},
+	&factoryResetCharacteristicUUID:                       {Name: "Factory Reset", DataType: schema.Uint8},
+	&attMTUCharacteristicUUID:                             {Name: "ATT MTU", DataType: schema.Uint16},
+	&sensorDataDigestConfirmCharacteristicUUID:            {Name: "Sensor Data Digest Confirm", DataType: schema.Bytes},
+	&sensorDataStreamCharacteristicUUID:                   {Name: "Sensor Data Stream", DataType: schema.Bytes},
+	&sensorDataRequestCharacteristicUUID:                  {Name: "Sensor Data Request", DataType: schema.Bytes},
+	&bluetooth.CharacteristicUUIDObjectActionControlPoint: {Name: "Object Action Control Point", DataType: schema.Bytes},
+	&bluetooth.CharacteristicUUIDObjectListControlPoint:   {Name: "Object List Control Point", DataType: schema.Bytes},
+	&objectDataCharacteristicUUID:                         {Name: "Object Data", DataType: schema.Bytes},
+	&dfuControlCharacteristicUUID:                         {Name: "DFU Control", DataType: schema.Bytes},
+	&dfuDataCharacteristicUUID:                            {Name: "DFU Data", DataType: schema.Bytes},
+}
+
+// Take the UUIDs of the keyed characteristics from the schema, so the
+// peripheral serves them under the UUIDs the app expects.
+func useSchemaUUIDs(s *schema.Schema) error {
+	var errs []error
+	for _, c := range s.Characteristics {
+		if c.Key == "" {
+			continue
+		}
+		target, ok := configurableUUIDs[c.Key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("characteristic %s (%s): unknown key %q", c.UUID, c.Name, c.Key))
+			continue
+		}
+		*target = bluetooth.NewUUID(uuid.MustParse(c.UUID))
+	}
+	return errors.Join(errs...)
+}
+
+// Group the characteristics of the stack into the services the schema lists,
+// add the descriptors of their descriptions and record the descriptions, which
+// then decide how writes are decoded and checked. Characteristics the schema
+// doesn't list stay in the service they are defined in, those it doesn't
+// describe get the descriptors of undescribedCharacteristics. Characteristics
+// whose storage or permissions disagree with their description, see
+// lintCharacteristic, are an error.
+func buildGATTStack(stack []bluetooth.Service, s *schema.Schema) ([]bluetooth.Service, error) {
+	owner := map[bluetooth.UUID]bluetooth.UUID{}
+	services := []bluetooth.Service{}
+	positions := map[bluetooth.UUID]int{}
+	position := func(serviceUUID bluetooth.UUID) int {
+		if i, ok := positions[serviceUUID]; ok {
+			return i
+		}
+		services = append(services, bluetooth.Service{UUID: serviceUUID})
+		positions[serviceUUID] = len(services) - 1
+		return len(services) - 1
+	}
+
+	for _, service := range s.Services {
+		serviceUUID := bluetooth.NewUUID(uuid.MustParse(service.UUID))
+		position(serviceUUID)
+		for _, id := range service.Characteristics {
+			owner[bluetooth.NewUUID(uuid.MustParse(id))] = serviceUUID
+		}
+	}
+
+	fallbacks := map[bluetooth.UUID]schema.Characteristic{}
+	for id, mapping := range undescribedCharacteristics {
+		fallbacks[*id] = mapping
+	}
+
+	implemented := map[bluetooth.UUID]bluetooth.CharacteristicConfig{}
+	for _, service := range stack {
+		for _, c := range service.Characteristics {
+			serviceUUID := service.UUID
+			if o, ok := owner[c.UUID]; ok {
+				serviceUUID = o
+			}
+			if mapping, ok := s.Characteristic(c.UUID.String()); ok {
+				c.Descriptors = characteristicDescriptors(mapping)
+			} else if mapping, ok := fallbacks[c.UUID]; ok {
+				c.Descriptors = characteristicDescriptors(mapping)
+			}
+			i := position(serviceUUID)
+			services[i].Characteristics = append(services[i].Characteristics, c)
+			implemented[c.UUID] = c
+		}
+	}
+
+	var errs []error
+	variables := characteristicVariablesByUUID()
+	for _, c := range s.Characteristics {
+		id := bluetooth.NewUUID(uuid.MustParse(c.UUID))
+		config, ok := implemented[id]
+		if !ok {
+			println("Schema characteristic", c.UUID, "("+c.Name+") isn't implemented by the peripheral.")
+			continue
+		}
+		for _, finding := range lintCharacteristic(c, config, variables) {
+			if finding.severity == "error" {
+				errs = append(errs, fmt.Errorf("characteristic %s (%s): %s", c.UUID, c.Name, finding.message))
+			}
+		}
+		characteristicSchema[id] = c
+	}
+
+	built := services[:0]
+	for _, service := range services {
+		if len(service.Characteristics) > 0 {
+			built = append(built, service)
+		}
+	}
+	return built, errors.Join(errs...)
+}
+
+// Human readable description of a characteristic for the startup log.
+func describeCharacteristic(id bluetooth.UUID) string {
+	c, ok := characteristicSchema[id]
+	if !ok {
+		return id.String()
+	}
+	description := id.String() + " " + c.Name + " (" + string(c.DataType)
+	if c.Unit != "" {
+		description += ", " + c.Unit
+	}
+	switch c.Editing {
+	case schema.EditingWrite:
+		description += fmt.Sprintf(", range %v", c.Range)
+	case schema.EditingSelection:
+		description += fmt.Sprintf(", options %v", c.SelectionOptions)
+	}
+	return description + ")"
+}
+
+// The 0x2901 user description and 0x2904 presentation format descriptors of
+// a characteristic, derived from its schema description.
+func characteristicDescriptors(c schema.Characteristic) []bluetooth.DescriptorConfig {
+	return []bluetooth.DescriptorConfig{
+		{UUID: bluetooth.New16BitUUID(schema.UserDescriptionUUID), Value: c.UserDescription()},
+		{UUID: bluetooth.New16BitUUID(schema.PresentationFormatUUID), Value: c.PresentationFormat()},
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go-ble/schema"
+
+	"tinygo.org/x/bluetooth"
+)
+
+func TestBuildGATTStackRepoSchema(t *testing.T) {
+	t.Cleanup(func() { clear(characteristicSchema) })
+	s, err := schema.Load(defaultSchemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := buildGATTStack(newGATTStack(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, service := range services {
+		for _, c := range service.Characteristics {
+			if c.UUID == sensorODRCharacteristicUUID && service.UUID != bluetooth.New16BitUUID(0x185A) {
+				t.Errorf("sensor ODR served in %s, want the 0x185A service", service.UUID.String())
+			}
+		}
+	}
+	if c, ok := characteristicSchema[sensorODRCharacteristicUUID]; !ok || c.Unit != "Hz" {
+		t.Errorf("sensor ODR described as %+v", c)
+	}
+
+	for _, service := range services {
+		for _, c := range service.Characteristics {
+			if c.UUID != advIntervalGlobalCharacteristicUUID {
+				continue
+			}
+			want := []bluetooth.DescriptorConfig{
+				{UUID: bluetooth.New16BitUUID(0x2901), Value: []byte("Advertising Interval (Global)")},
+				// uint16, exponent 0, second, Bluetooth SIG namespace, no description
+				{UUID: bluetooth.New16BitUUID(0x2904), Value: []byte{0x06, 0x00, 0x03, 0x27, 0x01, 0x00, 0x00}},
+			}
+			if !reflect.DeepEqual(c.Descriptors, want) {
+				t.Errorf("advertising interval (global) descriptors %v, want %v", c.Descriptors, want)
+			}
+		}
+	}
+}
+
+func TestBuildGATTStackDescriptors(t *testing.T) {
+	t.Cleanup(func() { clear(characteristicSchema) })
+	s, err := schema.Load(defaultSchemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := buildGATTStack(newGATTStack(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every characteristic of the stack, described by the schema or not
+	want := 0
+	for _, service := range newGATTStack() {
+		want += len(service.Characteristics)
+	}
+	got := 0
+	for _, service := range services {
+		for _, c := range service.Characteristics {
+			got++
+			var descriptors []bluetooth.UUID
+			for _, descriptor := range c.Descriptors {
+				descriptors = append(descriptors, descriptor.UUID)
+			}
+			if !reflect.DeepEqual(descriptors, []bluetooth.UUID{bluetooth.New16BitUUID(0x2901), bluetooth.New16BitUUID(0x2904)}) || len(c.Descriptors[0].Value) == 0 {
+				t.Errorf("%s has descriptors %v, want a named 0x2901 and 0x2904", c.UUID.String(), c.Descriptors)
+			}
+		}
+	}
+	if got != want {
+		t.Errorf("%d characteristics built, want %d", got, want)
+	}
+
+	// The fallback names what the schema leaves out
+	for _, service := range services {
+		for _, c := range service.Characteristics {
+			if c.UUID == rebootCharacteristicUUID && string(c.Descriptors[0].Value) != "Reboot" {
+				t.Errorf("reboot user description %q", c.Descriptors[0].Value)
+			}
+		}
+	}
+}
+
+func TestBuildGATTStackRejectsMismatches(t *testing.T) {
+	t.Cleanup(func() { clear(characteristicSchema) })
+	tests := []struct {
+		name    string
+		mapping string
+		want    string
+	}{
+		{"width", `{"name": "Transmit Power", "data_type": "int16"}`, "type width mismatch, declared int16 but stored as int8"},
+		{"signedness", `{"name": "Transmit Power", "data_type": "uint8"}`, "signedness mismatch, declared uint8 but stored as int8"},
+		{"editing", `{"name": "Boot Count", "data_type": "uint32", "editing": "write", "range": [0, 10]}`, `editing is "write" but the characteristic isn't writable`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := transmitPowerCharacteristicUUID
+			if test.name == "editing" {
+				id = bootCountCharacteristicUUID
+			}
+			s, err := schema.Parse([]byte(`{"characteristic_mappings": {"` + id.String() + `": ` + test.mapping + `}}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := buildGATTStack(newGATTStack(), s); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
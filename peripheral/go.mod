@@ -2,11 +2,14 @@ module go-ble
 
 go 1.23.2
 
+require (
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/google/uuid v1.6.0
+	tinygo.org/x/bluetooth v0.11.0
+)
+
 require (
 	github.com/go-ole/go-ole v1.2.6 // indirect
-	github.com/godbus/dbus/v5 v5.1.0 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/muka/go-bluetooth v0.0.0-20240701044517-04c4f09c514e // indirect
 	github.com/saltosystems/winrt-go v0.0.0-20240509164145-4f7860a3bd2b // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/soypat/cyw43439 v0.0.0-20241116210509-ae1ce0e084c5 // indirect
@@ -15,5 +18,9 @@ require (
 	github.com/tinygo-org/pio v0.0.0-20231216154340-cd888eb58899 // indirect
 	golang.org/x/exp v0.0.0-20230728194245-b0cb94b80691 // indirect
 	golang.org/x/sys v0.11.0 // indirect
-	tinygo.org/x/bluetooth v0.11.0 // indirect
 )
+
+// BlueZ backend with GATT descriptors and ATT errors for rejected writes:
+// v0.11.0 patched by third_party/bluetooth/apply.sh, see
+// third_party/bluetooth/README.md
+replace tinygo.org/x/bluetooth => ./third_party/bluetooth/module
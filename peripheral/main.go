@@ -2,13 +2,29 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"go-ble/codec"
+	"go-ble/export"
+	"go-ble/ots"
+	"go-ble/record"
+	"go-ble/schema"
+	"go-ble/spectrogram"
+
 	"github.com/google/uuid"
 	"tinygo.org/x/bluetooth"
 )
@@ -34,16 +50,79 @@ var (
 	deviceName  string = "TinyGo Sensor"
 	totalMemory uint64 = 0x100000 // 1MB
 
-	fwRevision     string = "0.1.0"
-	fwRevisionUUID        = bluetooth.NewUUID(
+	// Device Information Service (0x180A)
+	manufacturerName string = "MEMS_bluetooth"
+	modelNumber      string = "MEMS-BLE-SIM"
+	serialNumber     string = "SIM-000001"
+	hardwareRevision string = "1.0"
+	systemID         uint64 = 0x000000_0000000001 // OUI in the high 24 bits, manufacturer identifier in the low 40
+
+	disFirmwareRevisionHandle bluetooth.Characteristic
+
+	fwRevisionHandle bluetooth.Characteristic
+	fwRevision       string = "0.1.0"
+	fwRevisionUUID          = bluetooth.NewUUID(
 		uuid.MustParse("cabacafe-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
 	)
 
+	// Reboot command, boot counter and the reason of the last reset, see reboot.go
+	rebootHandle             bluetooth.Characteristic
+	rebootCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("b007c0de-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+	bootCountHandle             bluetooth.Characteristic
+	bootCountCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("b007c047-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+	bootCount                         uint32 = 0
+	lastResetReasonHandle             bluetooth.Characteristic
+	lastResetReasonCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("4e5e7a50-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+	lastResetReason byte = resetReasonPowerOn
+
+	// Result of the last write to a configuration register, see validate.go
+	writeStatusHandle             bluetooth.Characteristic
+	writeStatusCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("e4404000-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+
+	// Batch of register writes applied all-or-nothing, see transaction.go
+	configTransactionHandle             bluetooth.Characteristic
+	configTransactionCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("c0f17a40-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+	selfWritingConfigTransaction bool = false
+
+	// Incremented whenever the configuration registers change, and the time of
+	// the change, see nvm.go
+	configGenerationHandle             bluetooth.Characteristic
+	configGenerationCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("c0f16e40-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+	configGeneration                  uint32 = 0
+	configChangedAtHandle             bluetooth.Characteristic
+	configChangedAtCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("c0f1ca7e-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+	configChangedAt int64 = 0 // Unix microseconds, 0 until the first change
+
+	// Restores the configuration registers to their factory defaults, see nvm.go
+	factoryResetHandle             bluetooth.Characteristic
+	factoryResetCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("fac70000-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+
+	// Battery service (0x180F), see battery.go. The custom battery percentage
+	// characteristic the app reads is an alias of the standard Battery Level.
+	batteryLevelHandle      bluetooth.Characteristic
+	batteryLevelStateHandle bluetooth.Characteristic
+	batteryPowerStateHandle bluetooth.Characteristic
 	batteryPercentageHandle bluetooth.Characteristic
 	batteryPercentageUUID   = bluetooth.NewUUID(
 		uuid.MustParse("c0dec0fe-0bad-41c7-992f-a5d063dbfeee"),
 	)
-	batteryPercentage byte = 100
+	batteryPercentage byte = 100 // Guarded by batteryMutex, read it with batteryLevel
 
 	// Device log buffer
 	deviceLogHandle             bluetooth.Characteristic
@@ -51,6 +130,23 @@ var (
 		uuid.MustParse("beefc0de-f00d-4d3c-a1ca-ae3e7e098a2b"),
 	)
 	serializedDeviceLogData []byte
+	deviceLogMutex          sync.Mutex
+	deviceLogMaxSize        = maxTransferChunk // An attribute value is at most 512 bytes
+
+	// Length of the device log in bytes, saturating at 0xFFFF
+	deviceLogLengthHandle             bluetooth.Characteristic
+	deviceLogLengthCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("beefd1fa-f00d-4d3c-a1ca-ae3e7e098a2b"),
+	)
+	deviceLogLength uint16
+
+	// Unix time in ms written by the central after a transfer, the device clock
+	// isn't set from it, the offset is logged
+	unixTimeSyncHandle             bluetooth.Characteristic
+	unixTimeSyncCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("c0dec0fe-cafe-a1ca-992f-1b1b1b1b1b1b"),
+	)
+	unixTimeSync uint64
 
 	// Memory allocated percentage
 	memoryAllocatedPercentageHandle             bluetooth.Characteristic
@@ -91,18 +187,94 @@ var (
 		uuid.MustParse("c0debabe-face-4f89-b07d-f9d9b20a76c8"),
 	)
 	serializedSensorData       []byte
-	serializedSensorDataRange  []int
+	serializedSensorDataRange  = []int{0, 0} // Range of sensorDataTransfer published on sensorDataHandle
 	serializedSensorDataMutex  sync.Mutex
 	sensorDataInTransfer       bool = false
-	sensorDataMaxTransferChunk      = 420
+	sensorDataMaxTransferChunk      = 420 // Preferred chunk size, used while the ATT MTU is unknown
+
+	// Writable preferred chunk size, for stacks that don't expose the MTU
+	sensorDataChunkSizeHandle             bluetooth.Characteristic
+	sensorDataChunkSizeCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("c4a7c5e0-face-4f89-b07d-f9d9b20a76c8"),
+	)
+	selfWritingSensorDataChunkSize bool = false
+
+	// Negotiated ATT MTU as reported by the central, 0 while unknown. A single
+	// value: BlueZ doesn't tell connections apart, tinygo reports connection 0 for all.
+	attMTUHandle             bluetooth.Characteristic
+	attMTUCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("a77e7000-face-4f89-b07d-f9d9b20a76c8"),
+	)
+	connectionMTU uint16 = 0
+
+	// Records selected for the current transfer, copied out of serializedSensorData
+	sensorDataTransfer          []byte
+	sensorDataTransferRecords   []sensorDataTransferRecord
+	sensorDataTransferDelivered int       // Bytes of the transfer the central confirmed reading
+	sensorDataTransferActivity  time.Time // Last confirm or stream control write of the transfer
+
+	// Acknowledges and deletes records by ID
+	sensorDataAckHandle             bluetooth.Characteristic
+	sensorDataAckCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("ac4ed000-face-4f89-b07d-f9d9b20a76c8"),
+	)
+	sensorDataSynced         []uint32 // Records acknowledged by the central and not yet deleted
+	selfWritingSensorDataAck bool     = false
+
+	// SHA-256 over the whole transfer, computed when it starts
+	sensorDataDigestHandle             bluetooth.Characteristic
+	sensorDataDigestCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("d16e57ed-face-4f89-b07d-f9d9b20a76c8"),
+	)
+	sensorDataDigest         [sha256.Size]byte
+	sensorDataDigestVerified bool = false
+
+	// The digest the central computed over the bytes it received
+	sensorDataDigestConfirmHandle             bluetooth.Characteristic
+	sensorDataDigestConfirmCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("d16ec0f1-face-4f89-b07d-f9d9b20a76c8"),
+	)
+
+	// Credit based streaming of the selected records
+	sensorDataStreamHandle             bluetooth.Characteristic
+	sensorDataStreamCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("5742ea40-face-4f89-b07d-f9d9b20a76c8"),
+	)
+	sensorDataStreamControlHandle             bluetooth.Characteristic
+	sensorDataStreamControlCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("c0c7401e-face-4f89-b07d-f9d9b20a76c8"),
+	)
+	sensorDataStreamStatsHandle             bluetooth.Characteristic
+	sensorDataStreamStatsCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("57a75000-face-4f89-b07d-f9d9b20a76c8"),
+	)
+	sensorDataStream                sensorDataStreamStruct
+	selfWritingSensorDataStreamCtrl bool = false
+
+	// Catalog of the stored sensor records
+	sensorDataCatalogHandle             bluetooth.Characteristic
+	sensorDataCatalogCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("ca7a1060-face-4f89-b07d-f9d9b20a76c8"),
+	)
+	sensorDataCatalog             = []byte{0x00, 0x00}
+	sensorDataCatalogStart uint32 = 0
+
+	// Selects which records the transfer streams
+	sensorDataRequestHandle             bluetooth.Characteristic
+	sensorDataRequestCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("5e1ec7ed-face-4f89-b07d-f9d9b20a76c8"),
+	)
+	sensorDataSelection sensorDataSelectionStruct
 
 	// Total sensor data in memory, in bytes
 	sensorDataTotalHandle             bluetooth.Characteristic
 	sensorDataTotalCharacteristicUUID = bluetooth.NewUUID(
 		uuid.MustParse("0badf00d-cafe-4b1b-9b1b-2c931b1b1b1b"),
 	)
-	sensorDataTotal               uint32 = 0
-	sensorDataTotalAtBufferChange uint32 = 0
+	sensorDataTotal uint32 = 0 // Including staged data
+
+	// Sensor data received during a transfer, merged into serializedSensorData when it ends
+	sensorDataStaging []byte
 )
 
 // BLE core configuration
@@ -111,7 +283,7 @@ var (
 	transmitPowerCharacteristicUUID = bluetooth.NewUUID(
 		uuid.MustParse("b1eec10a-0007-4d3c-a1ca-ae3e7e098a2b"),
 	)
-	transmitPower            byte = 0 // 0 dBm
+	transmitPower            int8 = 0 // dBm
 	selfWritingTransmitPower bool = false
 
 	// How often to start advertising
@@ -150,407 +322,957 @@ var (
 var (
 	confirmReadHandle bluetooth.Characteristic
 	confirmReadUUID   = bluetooth.NewUUID(
-		uuid.MustParse("aaaaaaaa-face-4f89-b07d-f9d9b20a76c8"),
+		uuid.MustParse("0badf00d-babe-47f5-b542-bbfd9b436872"),
 	)
 	confirmReadValue = []byte{0x00}
 )
 
+// Object transfer service, see objects.go
+var (
+	objectNameHandle       bluetooth.Characteristic
+	objectTypeHandle       bluetooth.Characteristic
+	objectSizeHandle       bluetooth.Characteristic
+	objectIDHandle         bluetooth.Characteristic
+	objectPropertiesHandle bluetooth.Characteristic
+
+	objectActionHandle      bluetooth.Characteristic
+	selfWritingObjectAction bool = false
+	objectListHandle        bluetooth.Characteristic
+	selfWritingObjectList   bool = false
+
+	// Stands in for the L2CAP object transfer channel
+	objectDataHandle             bluetooth.Characteristic
+	objectDataCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("0b1ec7da-7a00-4f89-b07d-f9d9b20a76c8"),
+	)
+)
+
+// Simulated firmware update, see firmware.go
+var (
+	dfuServiceUUID = bluetooth.NewUUID(
+		uuid.MustParse("df000000-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+	dfuControlHandle             bluetooth.Characteristic
+	dfuControlCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("df000001-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+	dfuDataCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("df000002-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+	dfuStatusHandle             bluetooth.Characteristic
+	dfuStatusCharacteristicUUID = bluetooth.NewUUID(
+		uuid.MustParse("df000003-f00d-4b1b-9b1b-1b1b1b1b1b1b"),
+	)
+	selfWritingDFUStatus bool = false
+)
+
 var stopAdvertisingDueToDisconnect bool = false
 
-var GATTStack = []bluetooth.Service{
-	{
-		// Battery charge
-		UUID: bluetooth.ServiceUUIDBattery, //0x180F
-		Characteristics: []bluetooth.CharacteristicConfig{
-			{
-				Handle: &batteryPercentageHandle,
-				UUID:   batteryPercentageUUID,
-				Value:  []byte{batteryPercentage},
-				Flags:  bluetooth.CharacteristicReadPermission,
+// Last record ID handed out to a sensor or log record
+var (
+	lastRecordID     uint32 = 0
+	recordIDReserved uint32 = 0 // IDs up to this one are reserved in NVM
+	recordIDMutex    sync.Mutex
+)
+
+// Record IDs are reserved in NVM this many at a time. A process kill skips
+// the rest of the block instead of reusing IDs the central may have seen.
+const recordIDBlock = 64
+
+// Services of the peripheral. Built once the configuration is loaded, the
+// UUIDs and initial values come from it.
+func newGATTStack() []bluetooth.Service {
+	battery, batteryState := batteryLevel()
+
+	return []bluetooth.Service{
+		{
+			// Battery charge
+			UUID: bluetooth.ServiceUUIDBattery, //0x180F
+			Characteristics: []bluetooth.CharacteristicConfig{
+				{
+					Handle: &batteryLevelHandle,
+					UUID:   bluetooth.CharacteristicUUIDBatteryLevel, // 0x2A19
+					Value:  []byte{battery},
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				},
+				{
+					// Battery level followed by the power state
+					Handle: &batteryLevelStateHandle,
+					UUID:   bluetooth.CharacteristicUUIDBatteryLevelState, // 0x2A1B
+					Value:  []byte{battery, batteryState},
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				},
+				{
+					Handle: &batteryPowerStateHandle,
+					UUID:   bluetooth.CharacteristicUUIDBatteryPowerState, // 0x2A1A
+					Value:  []byte{batteryState},
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				},
+				{
+					Handle: &batteryPercentageHandle,
+					UUID:   batteryPercentageUUID,
+					Value:  []byte{battery},
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				},
 			},
 		},
-	},
-	{
-		UUID: bluetooth.ServiceUUIDTxPower, //0x1804
-		Characteristics: []bluetooth.CharacteristicConfig{
-			{
-				Handle: &transmitPowerHandle,
-				UUID:   transmitPowerCharacteristicUUID,
-				Value:  []byte{transmitPower},
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if selfWritingTransmitPower {
-						return
-					}
-
-					selfWritingTransmitPower = true
-					defer func() {
-						selfWritingTransmitPower = false
-					}()
-					if offset != 0 || len(value) != 1 {
-						println("Bad TransmitPower value: ", value)
-						return
-					}
-					transmitPower = value[0]
-					transmitPowerHandle.Write(ToByteArray(transmitPower))
-					println("Transmit power set to:", transmitPower)
+		{
+			UUID: bluetooth.ServiceUUIDTxPower, //0x1804
+			Characteristics: []bluetooth.CharacteristicConfig{
+				{
+					Handle:        &transmitPowerHandle,
+					UUID:          transmitPowerCharacteristicUUID,
+					Value:         ToByteArray(transmitPower),
+					Flags:         bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
+					ValidateWrite: registerWriteValidator[int8](transmitPowerCharacteristicUUID),
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingTransmitPower {
+							return
+						}
+
+						selfWritingTransmitPower = true
+						defer func() {
+							selfWritingTransmitPower = false
+						}()
+						n, ok := decodeRegisterWrite[int8](client, transmitPowerCharacteristicUUID, offset, value)
+						if !ok {
+							return
+						}
+
+						transmitPower = n
+						transmitPowerHandle.Write(ToByteArray(transmitPower))
+						println("Transmit power set to:", transmitPower)
+						saveConfig()
+						acceptWrite(transmitPowerCharacteristicUUID)
+					},
 				},
 			},
 		},
-	},
-	{
-		// Device configuration
-		UUID: bluetooth.New16BitUUID(0x1111), //0x1111
-		Characteristics: []bluetooth.CharacteristicConfig{
-			{
-				UUID:  bluetooth.CharacteristicUUIDDeviceName,
-				Value: []byte(deviceName),
-				Flags: bluetooth.CharacteristicReadPermission,
-			},
-			{
-				UUID:  fwRevisionUUID,
-				Value: []byte(fwRevision),
-				Flags: bluetooth.CharacteristicReadPermission,
-			},
-			{
-				Handle: &deviceLogHandle,
-				UUID:   deviceLogCharacteristicUUID,
-				Value:  serializedDeviceLogData,
-				Flags:  bluetooth.CharacteristicReadPermission,
-			},
-			{
-				Handle: &memoryAllocatedPercentageHandle,
-				UUID:   memoryAllocatedPercentageCharacteristicUUID,
-				Value:  []byte{memoryAllocatedPercentage},
-				Flags:  bluetooth.CharacteristicReadPermission,
-			},
-			{
-				Handle: &sensorDataTotalHandle,
-				UUID:   sensorDataTotalCharacteristicUUID,
-				Value:  ToByteArray(sensorDataTotal),
-				Flags:  bluetooth.CharacteristicReadPermission,
+		{
+			UUID: bluetooth.ServiceUUIDDeviceInformation, // 0x180A
+			Characteristics: []bluetooth.CharacteristicConfig{
+				{
+					UUID:  bluetooth.CharacteristicUUIDManufacturerNameString,
+					Value: []byte(manufacturerName),
+					Flags: bluetooth.CharacteristicReadPermission,
+				},
+				{
+					UUID:  bluetooth.CharacteristicUUIDModelNumberString,
+					Value: []byte(modelNumber),
+					Flags: bluetooth.CharacteristicReadPermission,
+				},
+				{
+					UUID:  bluetooth.CharacteristicUUIDSerialNumberString,
+					Value: []byte(serialNumber),
+					Flags: bluetooth.CharacteristicReadPermission,
+				},
+				{
+					UUID:  bluetooth.CharacteristicUUIDHardwareRevisionString,
+					Value: []byte(hardwareRevision),
+					Flags: bluetooth.CharacteristicReadPermission,
+				},
+				{
+					// Mirrors fwRevisionHandle, the custom characteristic the app reads
+					Handle: &disFirmwareRevisionHandle,
+					UUID:   bluetooth.CharacteristicUUIDFirmwareRevisionString,
+					Value:  []byte(fwRevision),
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					// Manufacturer identifier (uint40) followed by the OUI (uint24), little endian
+					UUID:  bluetooth.CharacteristicUUIDSystemID,
+					Value: ToByteArray(systemID),
+					Flags: bluetooth.CharacteristicReadPermission,
+				},
 			},
-			{
-				Handle: &autoDisconnectBitHandle,
-				UUID:   autoDisconnectBitCharacteristicUUID,
-				Value:  []byte{autoDisconnectBit},
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if selfWritingAutoDisconnectBit {
-						return
-					}
-
-					selfWritingAutoDisconnectBit = true
-					defer func() {
-						selfWritingAutoDisconnectBit = false
-					}()
-					if offset != 0 || len(value) != 1 {
-						println("Bad AutoDisconnectBit value: ", value)
-						return
-					}
-					autoDisconnectBit = value[0]
-					autoDisconnectBitHandle.Write(ToByteArray(autoDisconnectBit))
-					println("Auto disconnect bit set to:", autoDisconnectBit)
+		},
+		{
+			// Device configuration
+			UUID: bluetooth.New16BitUUID(0x1111), //0x1111
+			Characteristics: []bluetooth.CharacteristicConfig{
+				{
+					UUID:  bluetooth.CharacteristicUUIDDeviceName,
+					Value: []byte(deviceName),
+					Flags: bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &fwRevisionHandle,
+					UUID:   fwRevisionUUID,
+					Value:  []byte(fwRevision),
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &rebootHandle,
+					UUID:   rebootCharacteristicUUID,
+					Value:  []byte{0x00},
+					Flags:  bluetooth.CharacteristicWritePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if offset != 0 || len(value) != 1 || value[0] != rebootCommandReboot {
+							println("Bad Reboot value: ", value)
+							return
+						}
+						requestReboot(resetReasonSoftware)
+					},
+				},
+				{
+					Handle: &factoryResetHandle,
+					UUID:   factoryResetCharacteristicUUID,
+					Value:  []byte{0x00},
+					Flags:  bluetooth.CharacteristicWritePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if offset != 0 || len(value) != 1 || value[0] != factoryResetCommand {
+							println("Bad FactoryReset value: ", value)
+							return
+						}
+						factoryReset()
+					},
+				},
+				{
+					Handle: &writeStatusHandle,
+					UUID:   writeStatusCharacteristicUUID,
+					Value:  make([]byte, 17),
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				},
+				{
+					Handle:        &configTransactionHandle,
+					UUID:          configTransactionCharacteristicUUID,
+					Value:         []byte{},
+					Flags:         bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
+					ValidateWrite: validateConfigTransaction,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingConfigTransaction {
+							return
+						}
+						runConfigTransaction(client, value)
+					},
+				},
+				{
+					Handle: &configGenerationHandle,
+					UUID:   configGenerationCharacteristicUUID,
+					Value:  ToByteArray(configGeneration),
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				},
+				{
+					Handle: &configChangedAtHandle,
+					UUID:   configChangedAtCharacteristicUUID,
+					Value:  ToByteArray(configChangedAt),
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				},
+				{
+					Handle: &bootCountHandle,
+					UUID:   bootCountCharacteristicUUID,
+					Value:  ToByteArray(bootCount),
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &lastResetReasonHandle,
+					UUID:   lastResetReasonCharacteristicUUID,
+					Value:  []byte{lastResetReason},
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &deviceLogHandle,
+					UUID:   deviceLogCharacteristicUUID,
+					Value:  serializedDeviceLogData,
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &deviceLogLengthHandle,
+					UUID:   deviceLogLengthCharacteristicUUID,
+					Value:  ToByteArray(deviceLogLength),
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				},
+				{
+					Handle: &unixTimeSyncHandle,
+					UUID:   unixTimeSyncCharacteristicUUID,
+					Value:  ToByteArray(unixTimeSync),
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						synchronizeUnixTime(offset, value)
+					},
+				},
+				{
+					Handle: &memoryAllocatedPercentageHandle,
+					UUID:   memoryAllocatedPercentageCharacteristicUUID,
+					Value:  []byte{memoryAllocatedPercentage},
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &sensorDataTotalHandle,
+					UUID:   sensorDataTotalCharacteristicUUID,
+					Value:  ToByteArray(sensorDataTotal),
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle:        &autoDisconnectBitHandle,
+					UUID:          autoDisconnectBitCharacteristicUUID,
+					Value:         []byte{autoDisconnectBit},
+					Flags:         bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
+					ValidateWrite: registerWriteValidator[uint8](autoDisconnectBitCharacteristicUUID),
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingAutoDisconnectBit {
+							return
+						}
+
+						selfWritingAutoDisconnectBit = true
+						defer func() {
+							selfWritingAutoDisconnectBit = false
+						}()
+						n, ok := decodeRegisterWrite[uint8](client, autoDisconnectBitCharacteristicUUID, offset, value)
+						if !ok {
+							return
+						}
+
+						autoDisconnectBit = n
+						autoDisconnectBitHandle.Write(ToByteArray(autoDisconnectBit))
+						println("Auto disconnect bit set to:", autoDisconnectBit)
+						saveConfig()
+						acceptWrite(autoDisconnectBitCharacteristicUUID)
+					},
+				},
+				{
+					Handle:        &responseTimeoutHandle,
+					UUID:          responseTimeoutCharacteristicUUID,
+					Value:         []byte{responseTimeout},
+					Flags:         bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
+					ValidateWrite: registerWriteValidator[uint8](responseTimeoutCharacteristicUUID),
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingResponseTimeout {
+							return
+						}
+
+						selfWritingResponseTimeout = true
+						defer func() {
+							selfWritingResponseTimeout = false
+						}()
+						n, ok := decodeRegisterWrite[uint8](client, responseTimeoutCharacteristicUUID, offset, value)
+						if !ok {
+							return
+						}
+
+						responseTimeout = n
+						responseTimeoutHandle.Write(ToByteArray(responseTimeout))
+						println("Response timeout set to:", responseTimeout)
+						saveConfig()
+						acceptWrite(responseTimeoutCharacteristicUUID)
+					},
 				},
 			},
-			{
-				Handle: &responseTimeoutHandle,
-				UUID:   responseTimeoutCharacteristicUUID,
-				Value:  []byte{responseTimeout},
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if selfWritingResponseTimeout {
-						return
-					}
-
-					selfWritingResponseTimeout = true
-					defer func() {
-						selfWritingResponseTimeout = false
-					}()
-					if offset != 0 || len(value) != 1 {
-						println("Bad ResponseTimeout value: ", value)
-						return
-					}
-					responseTimeout = value[0]
-					responseTimeoutHandle.Write(ToByteArray(responseTimeout))
-					println("Response timeout set to:", responseTimeout)
+		},
+		{
+			UUID: bluetooth.New16BitUUID(0x1999),
+			Characteristics: []bluetooth.CharacteristicConfig{
+				{
+					Handle: &confirmReadHandle,
+					UUID:   confirmReadUUID,
+					Value:  confirmReadValue,
+					Flags:  bluetooth.CharacteristicWritePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						serializedSensorDataMutex.Lock()
+						defer serializedSensorDataMutex.Unlock()
+
+						confirmSensorDataRead(offset, value)
+					},
 				},
 			},
 		},
-	},
-	{
-		UUID: bluetooth.New16BitUUID(0x1999),
-		Characteristics: []bluetooth.CharacteristicConfig{
-			{
-				Handle: &confirmReadHandle,
-				UUID:   confirmReadUUID,
-				Value:  confirmReadValue,
-				Flags:  bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+		{
+			// Config and misc info
+			UUID: bluetooth.New16BitUUID(0x185A), // Industrial Measurement Device Service UUID
+			Characteristics: []bluetooth.CharacteristicConfig{
+				{
+					Handle:        &sensorODRHandle,
+					UUID:          sensorODRCharacteristicUUID, // Corrected UUID
+					Value:         ToByteArray(sensorODR),
+					Flags:         bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
+					ValidateWrite: registerWriteValidator[uint16](sensorODRCharacteristicUUID),
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingODR {
+							return
+						}
 
-					//FIXME: If new sensor data is written between the reading of the old one and confirmation of reading old one, it will be lost.
-					//Instead we must count the data. If the data length is higher than the data length at the moment of the read, we remove all but the new data.
-					// Each time 0x00 is received and data must be shuffled, we note the amount of data in the buffer.
-					// If data length is larger at the moment 0x01 is received, a part of data hasn't been sent and must be stored.
+						selfWritingODR = true
+						defer func() {
+							selfWritingODR = false
+						}()
 
-					sensorDataInTransfer = true
+						n, ok := decodeRegisterWrite[uint16](client, sensorODRCharacteristicUUID, offset, value)
+						if !ok {
+							return
+						}
 
-					serializedSensorDataMutex.Lock()
-					defer serializedSensorDataMutex.Unlock()
+						sensorODR = n
 
-					if offset != 0 || len(value) != 1 {
-						println("Bad ConfirmRead value: ", value)
-						return
-					}
+						sensorODRHandle.Write(ToByteArray(sensorODR))
+						println("Sensor ODR set to:", sensorODR)
+						saveConfig()
+						acceptWrite(sensorODRCharacteristicUUID)
+					},
+				},
+				{
+					Handle: &sensorDataHandle,
+					UUID:   sensorDataCharacteristicUUID, // UUID: c0debabe-face-4f89-b07d-f9d9b20a76c8
+					Value:  serializedSensorData,
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				},
+				{
+					Handle:        &sensorDataChunkSizeHandle,
+					UUID:          sensorDataChunkSizeCharacteristicUUID,
+					Value:         ToByteArray(uint16(sensorDataMaxTransferChunk)),
+					Flags:         bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
+					ValidateWrite: registerWriteValidator[uint16](sensorDataChunkSizeCharacteristicUUID),
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingSensorDataChunkSize {
+							return
+						}
+
+						selfWritingSensorDataChunkSize = true
+						defer func() {
+							selfWritingSensorDataChunkSize = false
+						}()
+
+						n, ok := decodeRegisterWrite[uint16](client, sensorDataChunkSizeCharacteristicUUID, offset, value)
+						if !ok {
+							return
+						}
 
-					confirmReadValue = value
+						serializedSensorDataMutex.Lock()
+						defer serializedSensorDataMutex.Unlock()
 
-					if confirmReadValue[0] == 0x01 {
-						println("Confirm read value set to:", confirmReadValue[0], "resetting all values...")
+						sensorDataMaxTransferChunk = int(n)
+						sensorDataChunkSizeHandle.Write(ToByteArray(uint16(sensorDataMaxTransferChunk)))
+						println("Sensor data chunk size set to:", sensorDataMaxTransferChunk)
+						acceptWrite(sensorDataChunkSizeCharacteristicUUID)
 
-						clearTransfer := func() {
-							sensorDataInTransfer = false
+						// Republish the current chunk in the new size
+						writeSensorDataChunk()
+					},
+				},
+				{
+					Handle:        &attMTUHandle,
+					UUID:          attMTUCharacteristicUUID,
+					Value:         ToByteArray(uint16(defaultATTMTU)),
+					Flags:         bluetooth.CharacteristicWritePermission,
+					ValidateWrite: registerWriteValidator[uint16](attMTUCharacteristicUUID),
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						mtu, ok := decodeRegisterWrite[uint16](client, attMTUCharacteristicUUID, offset, value)
+						if !ok {
+							return
 						}
 
-						defer clearTransfer()
+						serializedSensorDataMutex.Lock()
+						defer serializedSensorDataMutex.Unlock()
 
-						serializedSensorData = serializedSensorData[serializedSensorDataRange[1]:]
+						connectionMTU = mtu
+						println("ATT MTU set to:", mtu, "chunk size", sensorDataChunkSize())
 
-						if len(serializedSensorData) <= sensorDataMaxTransferChunk {
-							sensorDataHandle.Write(serializedSensorData)
-						} else {
-							sensorDataHandle.Write(serializedSensorData[:sensorDataMaxTransferChunk])
+						// Republish the current chunk in the new size
+						writeSensorDataChunk()
+					},
+				},
+				{
+					Handle: &sensorDataDigestHandle,
+					UUID:   sensorDataDigestCharacteristicUUID,
+					Value:  sensorDataDigest[:],
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &sensorDataDigestConfirmHandle,
+					UUID:   sensorDataDigestConfirmCharacteristicUUID,
+					Value:  []byte{},
+					Flags:  bluetooth.CharacteristicWritePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						serializedSensorDataMutex.Lock()
+						defer serializedSensorDataMutex.Unlock()
+
+						if offset != 0 || len(value) != sha256.Size {
+							println("Bad SensorDataDigestConfirm value: ", value)
+							return
 						}
 
-						serializedDeviceLogData = []byte{}
-						deviceLogHandle.Write(serializedDeviceLogData)
+						sensorDataDigestVerified = bytes.Equal(value, sensorDataDigest[:])
+						if !sensorDataDigestVerified {
+							println("Sensor data digest mismatch, data will be kept on confirm.")
+							return
+						}
+						println("Sensor data digest confirmed by the central.")
+					},
+				},
+				{
+					Handle: &sensorDataStreamHandle,
+					UUID:   sensorDataStreamCharacteristicUUID,
+					Value:  []byte{0x00, 0x00, 0x00},
+					Flags:  bluetooth.CharacteristicNotifyPermission,
+				},
+				{
+					Handle: &sensorDataStreamControlHandle,
+					UUID:   sensorDataStreamControlCharacteristicUUID,
+					Value:  sensorDataStream.status(),
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingSensorDataStreamCtrl {
+							return
+						}
 
-						println("Turning off adapter...")
+						selfWritingSensorDataStreamCtrl = true
+						defer func() {
+							selfWritingSensorDataStreamCtrl = false
+						}()
 
-						stopAdvertisingDueToDisconnect = true
-					} else { // Written 0
+						serializedSensorDataMutex.Lock()
+						defer serializedSensorDataMutex.Unlock()
 
-						sensorDataTotalAtBufferChange = sensorDataTotal
+						if offset != 0 || !sensorDataStream.control(value) {
+							println("Bad SensorDataStreamControl value: ", value)
+						}
+					},
+				},
+				{
+					Handle: &sensorDataStreamStatsHandle,
+					UUID:   sensorDataStreamStatsCharacteristicUUID,
+					Value:  make([]byte, 20),
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				},
+				{
+					Handle: &sensorDataCatalogHandle,
+					UUID:   sensorDataCatalogCharacteristicUUID,
+					Value:  sensorDataCatalog,
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &sensorDataRequestHandle,
+					UUID:   sensorDataRequestCharacteristicUUID,
+					Value:  []byte{sensorDataRequestAll},
+					Flags:  bluetooth.CharacteristicWritePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						serializedSensorDataMutex.Lock()
+						defer serializedSensorDataMutex.Unlock()
+
+						op, selection, ok := parseSensorDataRequest(value)
+						if offset != 0 || !ok {
+							println("Bad SensorDataRequest value: ", value)
+							return
+						}
 
-						println("Confirm read value set to:", confirmReadValue[0], "changing sensor data buffer...")
+						if op == sensorDataRequestCatalogPage {
+							sensorDataCatalogStart = binary.LittleEndian.Uint32(value[1:])
+							println("Sensor data catalog starts at record", sensorDataCatalogStart)
+							updateSensorDataCatalog()
+							return
+						}
+
+						// A new selection restarts the transfer from its first chunk
+						sensorDataSelection = selection
+						sensorDataInTransfer = false
+						flushSensorDataStaging()
+						startSensorDataTransfer()
+						println("Sensor data request selected", len(sensorDataTransferRecords), "records,", len(sensorDataTransfer), "bytes")
+					},
+				},
+				{
+					Handle: &sensorDataAckHandle,
+					UUID:   sensorDataAckCharacteristicUUID,
+					Value:  []byte{0x00},
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingSensorDataAck {
+							return
+						}
+
+						selfWritingSensorDataAck = true
+						defer func() {
+							selfWritingSensorDataAck = false
+						}()
+
+						serializedSensorDataMutex.Lock()
+						defer serializedSensorDataMutex.Unlock()
+
+						op, ids, ok := parseSensorDataAck(value)
+						if offset != 0 || !ok {
+							println("Bad SensorDataAck value: ", value)
+							return
+						}
+
+						rejected := applySensorDataAck(op, ids)
+
+						// Result: opcode, accepted count and the rejected IDs
+						result := []byte{op}
+						result = binary.LittleEndian.AppendUint16(result, uint16(len(ids)-len(rejected)))
+						for _, id := range rejected {
+							result = binary.LittleEndian.AppendUint32(result, id)
+						}
+						sensorDataAckHandle.Write(result)
+					},
+				},
+				{
+					Handle: &sensorDataClearBitHandle,
+					UUID:   sensorDataClearBitCharacteristicUUID,
+					Value:  []byte{sensorDataClearBit},
+
+					// Notify simulates indications.
+					Flags:         bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
+					ValidateWrite: registerWriteValidator[uint8](sensorDataClearBitCharacteristicUUID),
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingDataClearBit {
+							return
+						}
 
-						// Discard read sensor data
-						serializedSensorData = serializedSensorData[serializedSensorDataRange[1]:]
+						selfWritingDataClearBit = true
+						defer func() {
+							selfWritingDataClearBit = false
+						}()
 
-						if len(serializedSensorData) <= sensorDataMaxTransferChunk {
-							sensorDataHandle.Write(serializedSensorData)
-							serializedSensorDataRange = []int{0, len(serializedSensorData)}
+						n, ok := decodeRegisterWrite[uint8](client, sensorDataClearBitCharacteristicUUID, offset, value)
+						if !ok {
 							return
 						}
 
-						serializedSensorDataRange = []int{0, sensorDataMaxTransferChunk}
-						sensorDataHandle.Write(serializedSensorData[:sensorDataMaxTransferChunk])
-						println("Sensor data buffer changed.")
+						sensorDataClearBit = n
+
+						sensorDataClearBitHandle.Write(ToByteArray(sensorDataClearBit))
+						println("Sensor DataClearBit set to:", sensorDataClearBit)
+						saveConfig()
+						acceptWrite(sensorDataClearBitCharacteristicUUID)
+					},
+				},
+				{
+					Handle:        &advIntervalGlobalHandle,
+					UUID:          advIntervalGlobalCharacteristicUUID,
+					Value:         ToByteArray(advIntervalGlobal),
+					Flags:         bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
+					ValidateWrite: registerWriteValidator[uint16](advIntervalGlobalCharacteristicUUID),
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingAdvIntervalGlobal {
+							return
+						}
+
+						selfWritingAdvIntervalGlobal = true
+						defer func() {
+							selfWritingAdvIntervalGlobal = false
+						}()
+						n, ok := decodeRegisterWrite[uint16](client, advIntervalGlobalCharacteristicUUID, offset, value)
+						if !ok {
+							return
+						}
+
+						advIntervalGlobal = n
+						advIntervalGlobalHandle.Write(ToByteArray(advIntervalGlobal))
+						println("Advertising interval (global) set to:", advIntervalGlobal)
+						saveConfig()
+						acceptWrite(advIntervalGlobalCharacteristicUUID)
+					},
+				},
+				{
+					Handle:        &advDurationHandle,
+					UUID:          advDurationCharacteristicUUID,
+					Value:         ToByteArray(advDuration),
+					Flags:         bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
+					ValidateWrite: registerWriteValidator[uint16](advDurationCharacteristicUUID),
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingAdvDuration {
+							return
+						}
+
+						selfWritingAdvDuration = true
+						defer func() {
+							selfWritingAdvDuration = false
+						}()
+						n, ok := decodeRegisterWrite[uint16](client, advDurationCharacteristicUUID, offset, value)
+						if !ok {
+							return
+						}
+
+						advDuration = n
+						advDurationHandle.Write(ToByteArray(advDuration))
+						println("Advertising duration set to:", advDuration)
+						saveConfig()
+						acceptWrite(advDurationCharacteristicUUID)
+					},
+				},
+				{
+					Handle:        &advIntervalLocalHandle,
+					UUID:          advIntervalLocalCharacteristicUUID,
+					Value:         ToByteArray(advIntervalLocal),
+					Flags:         bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
+					ValidateWrite: registerWriteValidator[uint16](advIntervalLocalCharacteristicUUID),
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingAdvIntervalLocal {
+							return
+						}
 
-					}
+						selfWritingAdvIntervalLocal = true
+						defer func() {
+							selfWritingAdvIntervalLocal = false
+						}()
+						n, ok := decodeRegisterWrite[uint16](client, advIntervalLocalCharacteristicUUID, offset, value)
+						if !ok {
+							return
+						}
 
+						advIntervalLocal = n
+						advIntervalLocalHandle.Write(ToByteArray(advIntervalLocal))
+						println("Advertising interval (local) set to:", advIntervalLocal)
+						saveConfig()
+						acceptWrite(advIntervalLocalCharacteristicUUID)
+					},
 				},
 			},
 		},
-	},
-	{
-		// Config and misc info
-		UUID: bluetooth.New16BitUUID(0x185A), // Industrial Measurement Device Service UUID
-		Characteristics: []bluetooth.CharacteristicConfig{
-			{
-				Handle: &sensorODRHandle,
-				UUID:   sensorODRCharacteristicUUID, // Corrected UUID
-				Value:  ToByteArray(sensorODR),
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if selfWritingODR {
-						return
-					}
-
-					selfWritingODR = true
-					defer func() {
-						selfWritingODR = false
-					}()
-
-					if offset != 0 || len(value) > 2 {
-						println("Bad ODR value: ", value)
-						return
-					}
-
-					if len(value) == 1 {
-						newValue := make([]byte, 2)
-						newValue[0] = value[0]
-						newValue[1] = 0x00
-						value = newValue
-					}
-
-					sensorODR = binary.LittleEndian.Uint16(value)
-
-					sensorODRHandle.Write(ToByteArray(sensorODR))
-					println("Sensor ODR set to:", sensorODR)
+		{
+			// Object transfer, sensor data and device log as objects
+			UUID: bluetooth.ServiceUUIDObjectTransfer, // 0x1825
+			Characteristics: []bluetooth.CharacteristicConfig{
+				{
+					UUID:  bluetooth.CharacteristicUUIDOTSFeature,
+					Value: objectServer.Feature(),
+					Flags: bluetooth.CharacteristicReadPermission,
 				},
-			},
-			{
-				Handle: &sensorDataHandle,
-				UUID:   sensorDataCharacteristicUUID, // UUID: c0debabe-face-4f89-b07d-f9d9b20a76c8
-				Value:  serializedSensorData,
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
-			},
-			{
-				Handle: &sensorDataClearBitHandle,
-				UUID:   sensorDataClearBitCharacteristicUUID,
-				Value:  []byte{sensorDataClearBit},
+				{
+					Handle: &objectNameHandle,
+					UUID:   bluetooth.CharacteristicUUIDObjectName,
+					Value:  []byte{0x00},
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &objectTypeHandle,
+					UUID:   bluetooth.CharacteristicUUIDObjectType,
+					Value:  []byte{0x00, 0x00},
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &objectSizeHandle,
+					UUID:   bluetooth.CharacteristicUUIDObjectSize,
+					Value:  make([]byte, 8),
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &objectIDHandle,
+					UUID:   bluetooth.CharacteristicUUIDObjectID,
+					Value:  make([]byte, 6),
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &objectPropertiesHandle,
+					UUID:   bluetooth.CharacteristicUUIDObjectProperties,
+					Value:  make([]byte, 4),
+					Flags:  bluetooth.CharacteristicReadPermission,
+				},
+				{
+					Handle: &objectActionHandle,
+					UUID:   bluetooth.CharacteristicUUIDObjectActionControlPoint,
+					Value:  []byte{ots.OACPResponse},
+					Flags:  bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicIndicatePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingObjectAction {
+							return
+						}
+
+						selfWritingObjectAction = true
+						defer func() {
+							selfWritingObjectAction = false
+						}()
+
+						if offset != 0 || len(value) == 0 {
+							println("Bad ObjectActionControlPoint value: ", value)
+							return
+						}
+
+						response := objectServer.ActionControl(value)
+						objectActionHandle.Write(response)
+						println("Object action", value[0], "result:", response[2])
 
-				// Notify simulates indications.
-				Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if selfWritingDataClearBit {
-						return
-					}
+						objectMetadataChanged()
+					},
+				},
+				{
+					Handle: &objectListHandle,
+					UUID:   bluetooth.CharacteristicUUIDObjectListControlPoint,
+					Value:  []byte{ots.OLCPResponse},
+					Flags:  bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicIndicatePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						if selfWritingObjectList {
+							return
+						}
 
-					selfWritingDataClearBit = true
-					defer func() {
-						selfWritingDataClearBit = false
-					}()
+						selfWritingObjectList = true
+						defer func() {
+							selfWritingObjectList = false
+						}()
 
-					if offset != 0 || len(value) != 1 {
-						println("Bad DataClearBit value: ", value)
-						return
-					}
+						if offset != 0 || len(value) == 0 {
+							println("Bad ObjectListControlPoint value: ", value)
+							return
+						}
 
-					sensorDataClearBit = value[0]
+						response := objectServer.ListControl(value)
+						objectListHandle.Write(response)
+						println("Object list", value[0], "result:", response[2])
 
-					sensorDataClearBitHandle.Write(ToByteArray(sensorDataClearBit))
-					println("Sensor DataClearBit set to:", sensorDataClearBit)
+						objectMetadataChanged()
+					},
 				},
-			},
-			{
-				Handle: &advIntervalGlobalHandle,
-				UUID:   advIntervalGlobalCharacteristicUUID,
-				Value:  ToByteArray(advIntervalGlobal),
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if selfWritingAdvIntervalGlobal {
-						return
-					}
-
-					selfWritingAdvIntervalGlobal = true
-					defer func() {
-						selfWritingAdvIntervalGlobal = false
-					}()
-					if offset != 0 || len(value) > 2 {
-						println("Bad AdvIntervalGlobal value: ", value)
-						return
-					}
-
-					if len(value) == 1 {
-						newValue := make([]byte, 2)
-						newValue[0] = value[0]
-						newValue[1] = 0x00
-						value = newValue
-					}
-
-					advIntervalGlobal = binary.LittleEndian.Uint16(value)
-					advIntervalGlobalHandle.Write(ToByteArray(advIntervalGlobal))
-					println("Advertising interval (global) set to:", advIntervalGlobal)
+				{
+					Handle: &objectDataHandle,
+					UUID:   objectDataCharacteristicUUID,
+					Value:  []byte{0x00},
+					Flags:  bluetooth.CharacteristicNotifyPermission,
 				},
 			},
-			{
-				Handle: &advDurationHandle,
-				UUID:   advDurationCharacteristicUUID,
-				Value:  ToByteArray(advDuration),
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if selfWritingAdvDuration {
-						return
-					}
-
-					selfWritingAdvDuration = true
-					defer func() {
-						selfWritingAdvDuration = false
-					}()
-					if offset != 0 || len(value) > 2 {
-						println("Bad AdvDuration value: ", value)
-						return
-					}
-
-					if len(value) == 1 {
-						newValue := make([]byte, 2)
-						newValue[0] = value[0]
-						newValue[1] = 0x00
-						value = newValue
-					}
-
-					advDuration = binary.LittleEndian.Uint16(value)
-					advDurationHandle.Write(ToByteArray(advDuration))
-					println("Advertising duration set to:", advDuration)
+		},
+		{
+			// Simulated firmware update
+			UUID: dfuServiceUUID,
+			Characteristics: []bluetooth.CharacteristicConfig{
+				{
+					Handle: &dfuControlHandle,
+					UUID:   dfuControlCharacteristicUUID,
+					Value:  []byte{0x00},
+					Flags:  bluetooth.CharacteristicWritePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						dfuMutex.Lock()
+						defer dfuMutex.Unlock()
+
+						if offset != 0 {
+							println("Bad DFUControl value: ", value)
+							return
+						}
+
+						image := dfuTarget.Control(value)
+						publishDFUStatus()
+						println("DFU control state:", dfuTarget.Status()[0], "result:", dfuTarget.Status()[1])
+
+						if image != nil {
+							activateFirmware(image)
+						}
+					},
 				},
-			},
-			{
-				Handle: &advIntervalLocalHandle,
-				UUID:   advIntervalLocalCharacteristicUUID,
-				Value:  ToByteArray(advIntervalLocal),
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if selfWritingAdvIntervalLocal {
-						return
-					}
-
-					selfWritingAdvIntervalLocal = true
-					defer func() {
-						selfWritingAdvIntervalLocal = false
-					}()
-					if offset != 0 || len(value) > 2 {
-						println("Bad AdvIntervalLocal value: ", value)
-						return
-					}
-
-					if len(value) == 1 {
-						newValue := make([]byte, 2)
-						newValue[0] = value[0]
-						newValue[1] = 0x00
-						value = newValue
-					}
-
-					advIntervalLocal = binary.LittleEndian.Uint16(value)
-					advIntervalLocalHandle.Write(ToByteArray(advIntervalLocal))
-					println("Advertising interval (local) set to:", advIntervalLocal)
+				{
+					UUID:  dfuDataCharacteristicUUID,
+					Value: []byte{0x00},
+					Flags: bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
+					WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+						dfuMutex.Lock()
+						defer dfuMutex.Unlock()
+
+						if offset != 0 {
+							println("Bad DFUData value: ", value)
+							return
+						}
+
+						dfuTarget.Write(value)
+						publishDFUStatus()
+					},
+				},
+				{
+					Handle: &dfuStatusHandle,
+					UUID:   dfuStatusCharacteristicUUID,
+					Value:  dfuTarget.Status(),
+					Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
 				},
 			},
 		},
-	},
+	}
 }
 
+// Serialize a log entry into a framed record, see the record package for the layout.
 func SerializeLogs(result *[]byte, log logStruct) {
+	*result = record.AppendLog(*result, NextRecordID(), 0, record.Log{
+		Timestamp: log.timestamp,
+		Message:   log.message,
+	})
+}
 
-	var buffer [10]byte
-	binary.LittleEndian.PutUint64(buffer[:8], uint64(log.timestamp))
-	binary.LittleEndian.PutUint16(buffer[8:10], log.messageLength)
+func NewLogHandler(timestamp int64, log string) {
+	deviceLogMutex.Lock()
+	appendDeviceLog(timestamp, log)
+	deviceLogMutex.Unlock()
 
-	*result = append(*result, buffer[:]...)
-	*result = append(*result, log.message...)
+	objectMetadataChanged()
 }
 
-func NewLogHandler(timestamp int64, log string) {
+// Clear the device log, keeping the config audit records. An empty value
+// can't be published, so the cleared log ends with an entry saying why.
+func clearDeviceLog(reason string) {
+	deviceLogMutex.Lock()
+	serializedDeviceLogData = loadConfigAudit()
+	appendDeviceLog(time.Now().UnixMicro(), reason)
+	deviceLogMutex.Unlock()
+
+	objectMetadataChanged()
+}
+
+// Append a log entry and publish the log, dropping the oldest records beyond
+// deviceLogMaxSize. Returns the appended record. Caller must hold
+// deviceLogMutex.
+func appendDeviceLog(timestamp int64, log string) []byte {
 	logStructInstance := logStruct{
 		timestamp:     timestamp,
 		messageLength: uint16(len(log)),
 		message:       log,
 	}
+	start := len(serializedDeviceLogData)
 	SerializeLogs(&serializedDeviceLogData, logStructInstance)
+	entry := slices.Clone(serializedDeviceLogData[start:])
+
+	serializedDeviceLogData = trimRecords(serializedDeviceLogData, deviceLogMaxSize)
 	deviceLogHandle.Write(serializedDeviceLogData)
+
+	deviceLogLength = uint16(min(len(serializedDeviceLogData), math.MaxUint16))
+	deviceLogLengthHandle.Write(ToByteArray(deviceLogLength))
+	return entry
 }
 
-func SerializeSensorData(result *[]byte, dataStruct sensorDataStruct) {
+// Drop the oldest records of data until it fits limit bytes. The newest record
+// is always kept.
+func trimRecords(data []byte, limit int) []byte {
+	for len(data) > limit {
+		_, size, err := record.Decode(data)
+		if err != nil || size == len(data) {
+			break
+		}
+		data = data[size:]
+	}
+	return data
+}
+
+// Take the unix time in ms the central writes after a transfer. The simulated
+// device keeps its own clock, the offset to the central's is logged.
+func synchronizeUnixTime(offset int, value []byte) {
+	if offset != 0 || len(value) != 8 {
+		println("Rejected unix time", fmt.Sprintf("%x", value), "at offset", offset)
+		return
+	}
+	unixTimeSync = binary.LittleEndian.Uint64(value)
+
+	drift := int64(unixTimeSync) - time.Now().UnixMilli()
+	NewLogHandler(time.Now().UnixMicro(), fmt.Sprintf("Unix time synchronized by the central, offset %d ms", drift))
+	println("Unix time synchronized:", unixTimeSync, "offset", drift, "ms")
+}
 
-	var buffer [16]byte
-	binary.LittleEndian.PutUint64(buffer[:8], uint64(dataStruct.timestamp))
-	binary.LittleEndian.PutUint32(buffer[8:12], dataStruct.timeLength)
-	binary.LittleEndian.PutUint16(buffer[12:14], dataStruct.sensorODR)
-	binary.LittleEndian.PutUint16(buffer[14:16], dataStruct.dataLength)
+// Serialize a sensor event into a framed record, see the record package for the layout.
+func SerializeSensorData(result *[]byte, dataStruct sensorDataStruct) {
+	*result = record.AppendSensor(*result, NextRecordID(), 0, record.Sensor{
+		Timestamp:  dataStruct.timestamp,
+		TimeLength: dataStruct.timeLength,
+		ODR:        dataStruct.sensorODR,
+		Samples:    dataStruct.sensorData,
+	})
+}
 
-	*result = append(*result, buffer[:]...)
-	*result = append(*result, dataStruct.sensorData...)
+// Record IDs are shared by sensor and log records and never reused, across
+// reboots and process kills included.
+func NextRecordID() uint32 {
+	recordIDMutex.Lock()
+	defer recordIDMutex.Unlock()
+
+	lastRecordID++
+	if lastRecordID > recordIDReserved {
+		recordIDReserved = lastRecordID + recordIDBlock - 1
+		updateNVM(func(nvm *nvmStruct) {
+			nvm.LastRecordID = recordIDReserved
+		})
+	}
+	return lastRecordID
 }
 
 func NewSensorDataHandler(startTime int64, timeLength uint32, rawData []byte) {
@@ -566,7 +1288,11 @@ func NewSensorDataHandler(startTime int64, timeLength uint32, rawData []byte) {
 		sensorData: rawData,
 	}
 
-	SerializeSensorData(&serializedSensorData, dataStruct)
+	if sensorDataInTransfer {
+		SerializeSensorData(&sensorDataStaging, dataStruct)
+	} else {
+		SerializeSensorData(&serializedSensorData, dataStruct)
+	}
 
 	if false {
 		NewLogHandler(startTime+int64(timeLength), "New sensor data received")
@@ -579,30 +1305,21 @@ func NewSensorDataHandler(startTime int64, timeLength uint32, rawData []byte) {
 		println("Sensor ODR:", dataStruct.sensorODR, "Hz")
 		println("Sensor Data:", dataStruct.sensorData)
 		println("Data length:", dataStruct.dataLength, "raw bytes")
-		println("total packet size:", len(serializedSensorData), "bytes")
+		println("total packet size:", len(serializedSensorData)+len(sensorDataStaging), "bytes")
 		println("Memory consumption:", memoryAllocatedPercentage, "%")
-		println("Battery percentage:", batteryPercentage, "%")
+		battery, _ := batteryLevel()
+		println("Battery percentage:", battery, "%")
 		println()
 	}
 
-	memoryAllocatedPercentage = uint8((float64(len(serializedSensorData)) / float64(totalMemory)) * 100 / 2) // Fixed calculation for accuracy
-	memoryAllocatedPercentageHandle.Write([]byte{memoryAllocatedPercentage})
-
-	sensorDataTotal = uint32(len(serializedSensorData))
-	sensorDataTotalHandle.Write(ToByteArray(sensorDataTotal))
+	updateSensorDataTotals()
 
 	if sensorDataInTransfer {
-		println("New data written to serializedSensorData but ot sensorDataHandle due to ongoing transfer.")
+		println("New data staged due to ongoing transfer,", len(sensorDataStaging), "bytes waiting.")
 		return
 	}
 
-	if len(serializedSensorData) <= sensorDataMaxTransferChunk {
-		serializedSensorDataRange = []int{0, len(serializedSensorData)}
-	} else {
-		serializedSensorDataRange = []int{0, sensorDataMaxTransferChunk}
-	}
-
-	sensorDataHandle.Write(serializedSensorData[serializedSensorDataRange[0]:serializedSensorDataRange[1]])
+	startSensorDataTransfer()
 
 	println("New data written to sensorDataHandle. Notifying...")
 
@@ -646,46 +1363,78 @@ func sensorSimulator() {
 	}
 }
 
-// Convert the variables to bytes in Little Endian (Linux default)
+// Convert the variables to bytes in Little Endian (Linux default). Only
+// called with the types of the characteristic variables, any other type is a
+// programming error.
 func ToByteArray(value interface{}) []byte {
-	var buf []byte
-
-	switch v := value.(type) {
-	case int:
-		buf = make([]byte, 8)
-		binary.LittleEndian.PutUint64(buf, uint64(v))
-	case int8:
-		buf = []byte{byte(v)}
-	case int16:
-		buf = make([]byte, 2)
-		binary.LittleEndian.PutUint16(buf, uint16(v))
-	case int32:
-		buf = make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, uint32(v))
-	case int64:
-		buf = make([]byte, 8)
-		binary.LittleEndian.PutUint64(buf, uint64(v))
-	case uint:
-		buf = make([]byte, 8)
-		binary.LittleEndian.PutUint64(buf, uint64(v))
-	case uint8:
-		buf = []byte{v}
-	case uint16:
-		buf = make([]byte, 2)
-		binary.LittleEndian.PutUint16(buf, v)
-	case uint32:
-		buf = make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, v)
-	case uint64:
-		buf = make([]byte, 8)
-		binary.LittleEndian.PutUint64(buf, v)
-	default:
-		return nil
+	c, err := codec.Native(value)
+	if err != nil {
+		panic("ToByteArray: " + err.Error())
+	}
+	buf, err := c.Encode(value)
+	if err != nil {
+		panic("ToByteArray: " + err.Error())
 	}
-
 	return buf
 }
 
+// Export the sensor records currently in memory into dir as WAV, CSV and NumPy files.
+func ExportSensorData(dir string) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		println("Export failed:", err.Error())
+		return
+	}
+
+	for _, r := range storedSensorRecords() {
+		written, err := export.WriteFiles(dir, r.ID, *r.Sensor, export.Formats)
+		if err != nil {
+			println("Export of record", r.ID, "failed:", err.Error())
+		}
+		for _, path := range written {
+			println("Exported", path)
+		}
+	}
+}
+
+// Render the sensor records currently in memory into dir as PNG spectrograms,
+// consecutive records with the same ODR joined into one image.
+func RenderSensorData(dir string) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		println("Rendering failed:", err.Error())
+		return
+	}
+
+	var ids []uint32
+	var events []record.Sensor
+	for _, r := range storedSensorRecords() {
+		ids = append(ids, r.ID)
+		events = append(events, *r.Sensor)
+	}
+
+	for _, segment := range spectrogram.Join(ids, events) {
+		name := fmt.Sprintf("records %d-%d", segment.First, segment.Last)
+		img, err := spectrogram.Render(segment.Sensor, spectrogram.Options{})
+		if err != nil {
+			println("Rendering of", name, "failed:", err.Error())
+			continue
+		}
+
+		path := filepath.Join(dir, segment.Name()+".png")
+		file, err := os.Create(path)
+		if err != nil {
+			println("Rendering of", name, "failed:", err.Error())
+			continue
+		}
+		err = spectrogram.WritePNG(file, img)
+		file.Close()
+		if err != nil {
+			println("Rendering of", name, "failed:", err.Error())
+			continue
+		}
+		println("Rendered", path)
+	}
+}
+
 func setAdapterPowerState(state bool) error {
 	var powerState string = "off"
 
@@ -715,6 +1464,16 @@ func userInputListener(adv *bluetooth.Advertisement) {
 		} else if input.Text() == "off" {
 			adv.Stop()
 			setAdapterPowerState(false)
+		} else if dir, ok := strings.CutPrefix(input.Text(), "export "); ok {
+			ExportSensorData(dir)
+		} else if dir, ok := strings.CutPrefix(input.Text(), "spectrogram "); ok {
+			RenderSensorData(dir)
+		} else if input.Text() == "reboot" {
+			requestReboot(resetReasonPin)
+		} else if command, ok := strings.CutPrefix(input.Text(), "dfu "); ok {
+			dfuFailureInjection(command)
+		} else if command, ok := strings.CutPrefix(input.Text(), "battery "); ok {
+			batteryCommand(command)
 		}
 	}
 }
@@ -742,11 +1501,32 @@ func stopAdvertisingRoutine(adv *bluetooth.Advertisement) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gatt-lint" {
+		os.Exit(runGATTLint(os.Args[2:]))
+	}
+
+	config, err := loadPeripheralConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	must("load configuration", err)
+
+	gattSchema, err := schema.Load(config.SchemaPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Loading the GATT schema failed:", err)
+		fmt.Fprintln(os.Stderr, "The default schema path "+defaultSchemaPath+" is relative to the peripheral directory, set -schema-path or schema_path when running from elsewhere.")
+		os.Exit(1)
+	}
+	must("apply GATT schema", useSchemaUUIDs(gattSchema))
+	applyPeripheralConfig(config)
+	must("validate configuration", validateAppliedConfig(config, gattSchema))
+
 	println("Starting BLE application...")
 
 	println("Enabling BLE stack...")
 	setAdapterPowerState(true)
 	must("enable BLE stack", BLEAdapter.Enable())
+	must("watch disconnects", watchDisconnects(centralDisconnected))
 	println("BLE stack enabled.")
 
 	println("Configuring advertisement...")
@@ -756,15 +1536,31 @@ func main() {
 	}))
 	println("Advertisement configured.")
 
-	for _, service := range GATTStack {
+	setupObjectTransfer()
+
+	services, err := buildGATTStack(newGATTStack(), gattSchema)
+	must("build GATT stack", err)
+	for _, service := range services {
 		println("Adding service:", service.UUID.String())
+		for _, c := range service.Characteristics {
+			println("    ", describeCharacteristic(c.UUID))
+			for _, descriptor := range c.Descriptors {
+				println("        descriptor", descriptor.UUID.String(), fmt.Sprintf("%x", descriptor.Value))
+			}
+		}
 		must("add service", BLEAdapter.AddService(&service))
 	}
 
+	publishObjectMetadata()
+	boot()
+
 	go userInputListener(adv)
+	go rebootHandler(adv)
 	go sensorSimulator()
 	go stopAdvertisingRoutine(adv)
 	go batteryLevelHandler()
+	go objectMetadataPublisher()
+	go sensorDataTransferWatchdog()
 	//go advertisingHandler(adv)
 
 	println("Started advertising...")
@@ -793,14 +1589,6 @@ func advertisingHandler(adv *bluetooth.Advertisement) {
 	}
 }
 
-func batteryLevelHandler() {
-	for {
-		time.Sleep(time.Duration(15000+rand.Int()%10000) * time.Millisecond) // Randomized battery drain between 15 and 25 seconds per percent
-		batteryPercentage = batteryPercentage - 1
-		batteryPercentageHandle.Write([]byte{batteryPercentage})
-	}
-}
-
 func must(action string, err error) {
 	if err != nil {
 		panic(action + ": " + err.Error())
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// ToByteArray keeps the little endian layout of the Go type, for every type
+// the characteristics pass it.
+func TestToByteArray(t *testing.T) {
+	tests := []struct {
+		value any
+		want  []byte
+	}{
+		{uint8(0xAB), []byte{0xAB}},
+		{int8(-3), []byte{0xFD}},
+		{uint16(0x1234), []byte{0x34, 0x12}},
+		{uint32(0x12345678), []byte{0x78, 0x56, 0x34, 0x12}},
+		{uint64(1), []byte{1, 0, 0, 0, 0, 0, 0, 0}},
+		{int64(-2), []byte{0xFE, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{-2, []byte{0xFE, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+	}
+	for _, test := range tests {
+		if got := ToByteArray(test.value); !bytes.Equal(got, test.want) {
+			t.Errorf("ToByteArray(%T %v) = %x, want %x", test.value, test.value, got, test.want)
+		}
+	}
+}
+
+// Unsupported types used to encode as nil, which Characteristic.Write ignores.
+// No caller passes one, they now panic instead of publishing nothing.
+func TestToByteArrayUnsupportedType(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("ToByteArray(float64) didn't panic")
+		}
+	}()
+	ToByteArray(1.5)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// File standing in for the flash pages that survive a reset
+var nvmPath = "mems_nvm.json"
+
+// File standing in for the flash holding the sensor records, the memsdump format
+var sensorFlashPath = "mems_sensor_data.bin"
+
+// Contents of the simulated non-volatile memory
+type nvmStruct struct {
+	BootCount        uint32 `json:"boot_count"`
+	NextResetReason  byte   `json:"next_reset_reason"` // Reported by the next boot, power-on unless a reset was requested
+	FirmwareRevision string `json:"firmware_revision,omitempty"`
+	LastRecordID     uint32 `json:"last_record_id"`         // Highest reserved record ID, see recordIDBlock
+	ConfigGeneration uint32 `json:"config_generation"`      // Survives factory resets, so it never goes back
+	ConfigChangedAt  int64  `json:"config_changed_at"`      // Unix microseconds
+	ConfigAudit      []byte `json:"config_audit,omitempty"` // Framed log records of config writes, see appendConfigAudit
+
+	Config *nvmConfigStruct `json:"config,omitempty"` // Nil until a register is written, or after a factory reset
+}
+
+// Configuration registers kept in NVM
+type nvmConfigStruct struct {
+	SensorODR          uint16 `json:"sensor_odr"`
+	TransmitPower      int8   `json:"transmit_power"`
+	AdvIntervalGlobal  uint16 `json:"adv_interval_global"`
+	AdvDuration        uint16 `json:"adv_duration"`
+	AdvIntervalLocal   uint16 `json:"adv_interval_local"`
+	ResponseTimeout    byte   `json:"response_timeout"`
+	AutoDisconnectBit  byte   `json:"auto_disconnect_bit"`
+	SensorDataClearBit byte   `json:"sensor_data_clear_bit"`
+}
+
+// Factory reset opcode, written to factoryResetHandle
+const factoryResetCommand byte = 0x01
+
+// Register values the device starts with, the configured defaults
+var factoryConfig = currentConfig()
+
+// Held across every read-modify-write of the NVM, see updateNVM
+var nvmMutex sync.Mutex
+
+// Read, modify and write the simulated NVM as a single step, so concurrent
+// updates can't lose each other's changes. update must not block on other
+// locks. Returns the contents written.
+func updateNVM(update func(nvm *nvmStruct)) nvmStruct {
+	nvmMutex.Lock()
+	defer nvmMutex.Unlock()
+
+	nvm := readNVM()
+	update(&nvm)
+	writeNVM(nvm)
+	return nvm
+}
+
+// Read the simulated NVM, a missing file reads as erased memory. Caller must
+// hold nvmMutex.
+func readNVM() nvmStruct {
+	var nvm nvmStruct
+	data, err := os.ReadFile(nvmPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nvm
+	}
+	if err != nil {
+		println("Reading NVM failed:", err.Error())
+		return nvm
+	}
+	if err := json.Unmarshal(data, &nvm); err != nil {
+		println("NVM is corrupt, starting from erased memory:", err.Error())
+		return nvmStruct{}
+	}
+	return nvm
+}
+
+// Write the simulated NVM. The file is replaced atomically so that a crash
+// never leaves half written contents behind. Caller must hold nvmMutex.
+func writeNVM(nvm nvmStruct) {
+	data, err := json.MarshalIndent(nvm, "", "\t")
+	if err != nil {
+		println("Encoding NVM failed:", err.Error())
+		return
+	}
+
+	if err := writeFileAtomic(nvmPath, append(data, '\n')); err != nil {
+		println("Writing NVM failed:", err.Error())
+	}
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Read the sensor records kept in flash. Missing flash reads as empty.
+func loadSensorFlash() []byte {
+	data, err := os.ReadFile(sensorFlashPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		println("Reading sensor data flash failed:", err.Error())
+	}
+	return data
+}
+
+// Write the sensor records to flash, replacing its contents atomically.
+func saveSensorFlash(data []byte) {
+	if err := writeFileAtomic(sensorFlashPath, data); err != nil {
+		println("Writing sensor data flash failed:", err.Error())
+	}
+}
+
+func currentConfig() nvmConfigStruct {
+	return nvmConfigStruct{
+		SensorODR:          sensorODR,
+		TransmitPower:      transmitPower,
+		AdvIntervalGlobal:  advIntervalGlobal,
+		AdvDuration:        advDuration,
+		AdvIntervalLocal:   advIntervalLocal,
+		ResponseTimeout:    responseTimeout,
+		AutoDisconnectBit:  autoDisconnectBit,
+		SensorDataClearBit: sensorDataClearBit,
+	}
+}
+
+// Save the configuration registers, called after every accepted write. Only
+// a write that changes a register counts as a config change, writing the
+// value a register already holds leaves the generation alone.
+func saveConfig() {
+	config := currentConfig()
+
+	nvm := updateNVM(func(nvm *nvmStruct) {
+		saved := factoryConfig // No saved config means the factory defaults
+		if nvm.Config != nil {
+			saved = *nvm.Config
+		}
+		nvm.Config = &config
+		if config != saved {
+			countConfigChange(nvm)
+		}
+	})
+
+	publishConfigGeneration(nvm)
+}
+
+func countConfigChange(nvm *nvmStruct) {
+	nvm.ConfigGeneration++
+	nvm.ConfigChangedAt = time.Now().UnixMicro()
+}
+
+// Publish the config generation and the time of the last change. The central
+// compares the generation with the one it last read to detect changes made by
+// other centrals or the console.
+func publishConfigGeneration(nvm nvmStruct) {
+	configGeneration = nvm.ConfigGeneration
+	configChangedAt = nvm.ConfigChangedAt
+	configGenerationHandle.Write(ToByteArray(configGeneration))
+	configChangedAtHandle.Write(ToByteArray(configChangedAt))
+}
+
+// Set the configuration registers without publishing them.
+func setConfig(config nvmConfigStruct) {
+	sensorODR = config.SensorODR
+	transmitPower = config.TransmitPower
+	advIntervalGlobal = config.AdvIntervalGlobal
+	advDuration = config.AdvDuration
+	advIntervalLocal = config.AdvIntervalLocal
+	responseTimeout = config.ResponseTimeout
+	autoDisconnectBit = config.AutoDisconnectBit
+	sensorDataClearBit = config.SensorDataClearBit
+}
+
+// Set the configuration registers and publish them on their characteristics.
+func applyConfig(config nvmConfigStruct) {
+	setConfig(config)
+
+	writeConfigRegister(&sensorODRHandle, &selfWritingODR, ToByteArray(sensorODR))
+	writeConfigRegister(&transmitPowerHandle, &selfWritingTransmitPower, ToByteArray(transmitPower))
+	writeConfigRegister(&advIntervalGlobalHandle, &selfWritingAdvIntervalGlobal, ToByteArray(advIntervalGlobal))
+	writeConfigRegister(&advDurationHandle, &selfWritingAdvDuration, ToByteArray(advDuration))
+	writeConfigRegister(&advIntervalLocalHandle, &selfWritingAdvIntervalLocal, ToByteArray(advIntervalLocal))
+	writeConfigRegister(&responseTimeoutHandle, &selfWritingResponseTimeout, ToByteArray(responseTimeout))
+	writeConfigRegister(&autoDisconnectBitHandle, &selfWritingAutoDisconnectBit, ToByteArray(autoDisconnectBit))
+	writeConfigRegister(&sensorDataClearBitHandle, &selfWritingDataClearBit, ToByteArray(sensorDataClearBit))
+}
+
+func writeConfigRegister(handle *bluetooth.Characteristic, selfWriting *bool, value []byte) {
+	*selfWriting = true
+	handle.Write(value)
+	*selfWriting = false
+}
+
+// Restore the configuration registers saved in NVM, if any.
+func restoreConfig(nvm nvmStruct) {
+	if nvm.Config == nil {
+		return
+	}
+	applyConfig(*nvm.Config)
+	println("Configuration restored from NVM.")
+}
+
+// Erase the saved configuration and return every register to its factory default.
+func factoryReset() {
+	nvm := updateNVM(func(nvm *nvmStruct) {
+		nvm.Config = nil
+		countConfigChange(nvm)
+	})
+	publishConfigGeneration(nvm)
+
+	applyConfig(factoryConfig)
+
+	NewLogHandler(time.Now().UnixMicro(), "Factory reset")
+	println("Configuration reset to factory defaults.")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestUpdateNVMConcurrent(t *testing.T) {
+	saved := nvmPath
+	defer func() { nvmPath = saved }()
+	nvmPath = filepath.Join(t.TempDir(), "nvm.json")
+
+	// Boots racing record ID reservations, each must keep the other's update
+	const updates = 50
+	var wg sync.WaitGroup
+	for i := range updates {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			updateNVM(func(nvm *nvmStruct) { nvm.BootCount++ })
+		}()
+		go func() {
+			defer wg.Done()
+			updateNVM(func(nvm *nvmStruct) { nvm.LastRecordID = max(nvm.LastRecordID, uint32(i+1)) })
+		}()
+	}
+	wg.Wait()
+
+	nvm := updateNVM(func(*nvmStruct) {})
+	if nvm.BootCount != updates || nvm.LastRecordID != updates {
+		t.Fatalf("boot count %d, last record ID %d, want %d each", nvm.BootCount, nvm.LastRecordID, updates)
+	}
+}
+
+func TestSaveConfigSameValue(t *testing.T) {
+	savedPath, savedConfig, savedGeneration := nvmPath, currentConfig(), configGeneration
+	defer func() { nvmPath, configGeneration = savedPath, savedGeneration; setConfig(savedConfig) }()
+	nvmPath = filepath.Join(t.TempDir(), "nvm.json")
+
+	tests := []struct {
+		name       string
+		update     func(*nvmConfigStruct)
+		generation uint32 // Generation after the write
+	}{
+		{"factory default rewritten", func(*nvmConfigStruct) {}, 0},
+		{"changed", func(c *nvmConfigStruct) { c.SensorODR = factoryConfig.SensorODR + 1 }, 1},
+		{"same value", func(c *nvmConfigStruct) { c.SensorODR = factoryConfig.SensorODR + 1 }, 1},
+		{"changed back", func(*nvmConfigStruct) {}, 2},
+	}
+	for _, test := range tests {
+		config := factoryConfig
+		test.update(&config)
+		setConfig(config)
+		saveConfig()
+
+		nvm := updateNVM(func(*nvmStruct) {})
+		if nvm.ConfigGeneration != test.generation || configGeneration != test.generation {
+			t.Errorf("%s: generation %d, published %d, want %d", test.name, nvm.ConfigGeneration, configGeneration, test.generation)
+		}
+		if (nvm.ConfigChangedAt != 0) != (test.generation != 0) {
+			t.Errorf("%s: changed at %d with generation %d", test.name, nvm.ConfigChangedAt, test.generation)
+		}
+	}
+}
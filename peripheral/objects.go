@@ -0,0 +1,99 @@
+package main
+
+import (
+	"slices"
+
+	"go-ble/ots"
+)
+
+// Object IDs of the blobs exposed through the Object Transfer Service
+const (
+	sensorDataObjectID = ots.FirstObjectID + iota
+	deviceLogObjectID
+)
+
+// Object Transfer Service server, sending object contents as notifications on the data channel characteristic
+var objectServer = ots.NewServer(
+	func(chunk []byte) {
+		objectDataHandle.Write(chunk)
+	},
+	func() int {
+		return sensorDataChunkSize()
+	},
+)
+
+func setupObjectTransfer() {
+	objectServer.Add(&ots.Object{
+		ID:   sensorDataObjectID,
+		Name: "sensor-data",
+		Type: ots.TypeUnspecified,
+		Read: func() []byte {
+			serializedSensorDataMutex.Lock()
+			defer serializedSensorDataMutex.Unlock()
+
+			return slices.Clone(serializedSensorData)
+		},
+		Size: func() int {
+			serializedSensorDataMutex.Lock()
+			defer serializedSensorDataMutex.Unlock()
+
+			return len(serializedSensorData)
+		},
+		// Sensor records are deleted by ID through the sensor data acknowledge characteristic
+	})
+
+	objectServer.Add(&ots.Object{
+		ID:   deviceLogObjectID,
+		Name: "device-log",
+		Type: ots.TypeUnspecified,
+		Read: func() []byte {
+			deviceLogMutex.Lock()
+			defer deviceLogMutex.Unlock()
+
+			return slices.Clone(serializedDeviceLogData)
+		},
+		Size: func() int {
+			deviceLogMutex.Lock()
+			defer deviceLogMutex.Unlock()
+
+			return len(serializedDeviceLogData)
+		},
+		Delete: func() error {
+			clearDeviceLog("Device log deleted through the object transfer service")
+			println("Device log deleted through the object transfer service.")
+			return nil
+		},
+	})
+}
+
+// Signals objectMetadataPublisher. Buffered, changes made while it publishes
+// are coalesced into a single further publication.
+var objectMetadataChanges = make(chan struct{}, 1)
+
+// Request a metadata publication. Safe to call while holding the locks of the
+// objects, unlike publishObjectMetadata.
+func objectMetadataChanged() {
+	select {
+	case objectMetadataChanges <- struct{}{}:
+	default:
+	}
+}
+
+// Publish the metadata after changes, one publication at a time.
+func objectMetadataPublisher() {
+	for range objectMetadataChanges {
+		publishObjectMetadata()
+	}
+}
+
+// Publish the metadata characteristics of the current object. Must not be
+// called while holding serializedSensorDataMutex or deviceLogMutex.
+func publishObjectMetadata() {
+	metadata := objectServer.Metadata()
+
+	objectNameHandle.Write(metadata.Name)
+	objectTypeHandle.Write(metadata.Type)
+	objectSizeHandle.Write(metadata.Size)
+	objectIDHandle.Write(metadata.ID)
+	objectPropertiesHandle.Write(metadata.Properties)
+}
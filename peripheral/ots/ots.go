@@ -0,0 +1,281 @@
+// Package ots implements the procedures of an Object Transfer Service (0x1825)
+// server: object selection through the Object List Control Point, reads,
+// checksums and deletion through the Object Action Control Point, and the
+// metadata characteristic values of the current object.
+//
+// The L2CAP data channel of the specification isn't available to the
+// peripheral, object contents are sent in chunks through a data function
+// instead, typically notifications on a data channel characteristic.
+package ots
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+)
+
+// Object types, 16-bit UUIDs of the object type characteristic.
+const (
+	TypeUnspecified uint16 = 0x2ACA
+)
+
+// Object property bits.
+const (
+	PropertyDelete uint32 = 1 << 0
+	PropertyRead   uint32 = 1 << 2
+)
+
+// First object ID available to objects, lower IDs are reserved for the directory listing.
+const FirstObjectID uint64 = 0x100
+
+// Object Action Control Point opcodes and result codes.
+const (
+	OACPDelete            byte = 0x02
+	OACPCalculateChecksum byte = 0x03
+	OACPRead              byte = 0x05
+	OACPAbort             byte = 0x07
+	OACPResponse          byte = 0x60
+
+	OACPSuccess               byte = 0x01
+	OACPOpCodeNotSupported    byte = 0x02
+	OACPInvalidParameter      byte = 0x03
+	OACPInvalidObject         byte = 0x05
+	OACPProcedureNotPermitted byte = 0x08
+	OACPOperationFailed       byte = 0x0A
+)
+
+// Object List Control Point opcodes and result codes.
+const (
+	OLCPFirst           byte = 0x01
+	OLCPLast            byte = 0x02
+	OLCPPrevious        byte = 0x03
+	OLCPNext            byte = 0x04
+	OLCPGoTo            byte = 0x05
+	OLCPNumberOfObjects byte = 0x07
+	OLCPResponse        byte = 0x70
+
+	OLCPSuccess            byte = 0x01
+	OLCPOpCodeNotSupported byte = 0x02
+	OLCPInvalidParameter   byte = 0x03
+	OLCPOutOfBounds        byte = 0x05
+	OLCPNoObject           byte = 0x07
+	OLCPObjectIDNotFound   byte = 0x08
+)
+
+// Object is a blob exposed by the server. Read returns a snapshot of the
+// current contents, Size their length without copying them; with Size nil the
+// length of a Read is used. Delete is nil for objects that cannot be deleted.
+type Object struct {
+	ID     uint64
+	Name   string
+	Type   uint16
+	Read   func() []byte
+	Size   func() int
+	Delete func() error
+}
+
+// Properties returns the object property bits.
+func (o *Object) Properties() uint32 {
+	properties := PropertyRead
+	if o.Delete != nil {
+		properties |= PropertyDelete
+	}
+	return properties
+}
+
+// Server holds the object list and the current object.
+type Server struct {
+	mutex   sync.Mutex
+	objects []*Object
+	current int
+
+	send      func([]byte)
+	chunkSize func() int
+}
+
+// NewServer returns a server sending object contents through send, in chunks
+// of chunkSize bytes.
+func NewServer(send func([]byte), chunkSize func() int) *Server {
+	return &Server{current: -1, send: send, chunkSize: chunkSize}
+}
+
+// Add appends an object to the list. The first object added becomes current.
+func (s *Server) Add(o *Object) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.objects = append(s.objects, o)
+	if s.current < 0 {
+		s.current = 0
+	}
+}
+
+// Current returns the current object, or nil if there is none.
+func (s *Server) Current() *Object {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.current < 0 {
+		return nil
+	}
+	return s.objects[s.current]
+}
+
+// Feature returns the OTS Feature value: supported OACP and OLCP procedures.
+func (s *Server) Feature() []byte {
+	// OACP: read, delete, calculate checksum, abort. OLCP: go to, request number of objects.
+	oacp := uint32(1<<1 | 1<<2 | 1<<4 | 1<<9)
+	olcp := uint32(1<<0 | 1<<2)
+	feature := binary.LittleEndian.AppendUint32(nil, oacp)
+	return binary.LittleEndian.AppendUint32(feature, olcp)
+}
+
+// Metadata values of the current object.
+type Metadata struct {
+	Name       []byte
+	Type       []byte
+	Size       []byte // Current size and allocated size
+	ID         []byte
+	Properties []byte
+}
+
+// Metadata returns the characteristic values describing the current object.
+func (s *Server) Metadata() Metadata {
+	o := s.Current()
+	if o == nil {
+		return Metadata{Name: []byte{0}, Type: []byte{0, 0}, Size: make([]byte, 8), ID: make([]byte, 6), Properties: make([]byte, 4)}
+	}
+
+	var size uint32
+	if o.Size != nil {
+		size = uint32(o.Size())
+	} else {
+		size = uint32(len(o.Read()))
+	}
+	sizeValue := binary.LittleEndian.AppendUint32(nil, size)
+	return Metadata{
+		Name:       []byte(o.Name),
+		Type:       binary.LittleEndian.AppendUint16(nil, o.Type),
+		Size:       binary.LittleEndian.AppendUint32(sizeValue, size),
+		ID:         objectID(o.ID),
+		Properties: binary.LittleEndian.AppendUint32(nil, o.Properties()),
+	}
+}
+
+// ListControl executes an Object List Control Point request and returns the response.
+func (s *Server) ListControl(request []byte) []byte {
+	if len(request) == 0 {
+		return []byte{OLCPResponse, 0, OLCPInvalidParameter}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	op, args := request[0], request[1:]
+	respond := func(result byte, parameter ...byte) []byte {
+		return append([]byte{OLCPResponse, op, result}, parameter...)
+	}
+
+	if op != OLCPGoTo && op != OLCPNumberOfObjects && len(args) != 0 {
+		return respond(OLCPInvalidParameter)
+	}
+	if len(s.objects) == 0 && op != OLCPNumberOfObjects {
+		return respond(OLCPNoObject)
+	}
+
+	switch op {
+	case OLCPFirst:
+		s.current = 0
+	case OLCPLast:
+		s.current = len(s.objects) - 1
+	case OLCPPrevious:
+		if s.current <= 0 {
+			return respond(OLCPOutOfBounds)
+		}
+		s.current--
+	case OLCPNext:
+		if s.current >= len(s.objects)-1 {
+			return respond(OLCPOutOfBounds)
+		}
+		s.current++
+	case OLCPGoTo:
+		if len(args) != 6 {
+			return respond(OLCPInvalidParameter)
+		}
+		id := uint64(binary.LittleEndian.Uint32(args[0:4])) | uint64(binary.LittleEndian.Uint16(args[4:6]))<<32
+		for i, o := range s.objects {
+			if o.ID == id {
+				s.current = i
+				return respond(OLCPSuccess)
+			}
+		}
+		return respond(OLCPObjectIDNotFound)
+	case OLCPNumberOfObjects:
+		return respond(OLCPSuccess, binary.LittleEndian.AppendUint32(nil, uint32(len(s.objects)))...)
+	default:
+		return respond(OLCPOpCodeNotSupported)
+	}
+	return respond(OLCPSuccess)
+}
+
+// ActionControl executes an Object Action Control Point request on the
+// current object and returns the response. Reads send the requested range
+// before returning.
+func (s *Server) ActionControl(request []byte) []byte {
+	if len(request) == 0 {
+		return []byte{OACPResponse, 0, OACPInvalidParameter}
+	}
+
+	op, args := request[0], request[1:]
+	respond := func(result byte, parameter ...byte) []byte {
+		return append([]byte{OACPResponse, op, result}, parameter...)
+	}
+
+	o := s.Current()
+	if o == nil && op != OACPAbort {
+		return respond(OACPInvalidObject)
+	}
+
+	switch op {
+	case OACPRead, OACPCalculateChecksum:
+		if len(args) != 8 {
+			return respond(OACPInvalidParameter)
+		}
+		data := o.Read()
+		offset := int(binary.LittleEndian.Uint32(args[0:4]))
+		length := int(binary.LittleEndian.Uint32(args[4:8]))
+		if offset > len(data) || length > len(data)-offset {
+			return respond(OACPInvalidParameter)
+		}
+		data = data[offset : offset+length]
+
+		if op == OACPCalculateChecksum {
+			return respond(OACPSuccess, binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(data))...)
+		}
+		for chunk := s.chunkSize(); len(data) > 0; {
+			n := min(chunk, len(data))
+			s.send(data[:n])
+			data = data[n:]
+		}
+	case OACPDelete:
+		if len(args) != 0 {
+			return respond(OACPInvalidParameter)
+		}
+		if o.Delete == nil {
+			return respond(OACPProcedureNotPermitted)
+		}
+		if err := o.Delete(); err != nil {
+			return respond(OACPOperationFailed)
+		}
+	case OACPAbort:
+		// Reads complete before the response is sent, there is never anything to abort.
+	default:
+		return respond(OACPOpCodeNotSupported)
+	}
+	return respond(OACPSuccess)
+}
+
+func objectID(id uint64) []byte {
+	value := binary.LittleEndian.AppendUint32(nil, uint32(id))
+	return binary.LittleEndian.AppendUint16(value, uint16(id>>32))
+}
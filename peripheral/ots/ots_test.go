@@ -0,0 +1,188 @@
+package ots
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+var content = []byte("0123456789abcdefghij")
+
+// A server with a readable object and a deletable one, sending in chunks of 8 bytes.
+func newTestServer(sent *[][]byte, deleted *bool, deleteErr error) *Server {
+	s := NewServer(func(chunk []byte) {
+		*sent = append(*sent, bytes.Clone(chunk))
+	}, func() int { return 8 })
+	s.Add(&Object{ID: FirstObjectID, Name: "data", Type: TypeUnspecified, Read: func() []byte { return content }})
+	s.Add(&Object{ID: FirstObjectID + 1, Name: "log", Type: TypeUnspecified, Read: func() []byte { return content[:4] },
+		Delete: func() error {
+			*deleted = true
+			return deleteErr
+		}})
+	return s
+}
+
+func goTo(id uint64) []byte {
+	return append([]byte{OLCPGoTo}, objectID(id)...)
+}
+
+func TestListControl(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests [][]byte // Earlier requests select the object the last one starts from
+		response []byte
+		current  uint64
+	}{
+		{"first", [][]byte{{OLCPLast}, {OLCPFirst}}, []byte{OLCPResponse, OLCPFirst, OLCPSuccess}, FirstObjectID},
+		{"last", [][]byte{{OLCPLast}}, []byte{OLCPResponse, OLCPLast, OLCPSuccess}, FirstObjectID + 1},
+		{"next", [][]byte{{OLCPNext}}, []byte{OLCPResponse, OLCPNext, OLCPSuccess}, FirstObjectID + 1},
+		{"next past the end", [][]byte{{OLCPLast}, {OLCPNext}}, []byte{OLCPResponse, OLCPNext, OLCPOutOfBounds}, FirstObjectID + 1},
+		{"previous", [][]byte{{OLCPLast}, {OLCPPrevious}}, []byte{OLCPResponse, OLCPPrevious, OLCPSuccess}, FirstObjectID},
+		{"previous before the start", [][]byte{{OLCPPrevious}}, []byte{OLCPResponse, OLCPPrevious, OLCPOutOfBounds}, FirstObjectID},
+		{"go to", [][]byte{goTo(FirstObjectID + 1)}, []byte{OLCPResponse, OLCPGoTo, OLCPSuccess}, FirstObjectID + 1},
+		{"go to unknown ID", [][]byte{goTo(FirstObjectID + 7)}, []byte{OLCPResponse, OLCPGoTo, OLCPObjectIDNotFound}, FirstObjectID},
+		{"go to truncated ID", [][]byte{{OLCPGoTo, 0x01}}, []byte{OLCPResponse, OLCPGoTo, OLCPInvalidParameter}, FirstObjectID},
+		{"number of objects", [][]byte{{OLCPNumberOfObjects}}, []byte{OLCPResponse, OLCPNumberOfObjects, OLCPSuccess, 2, 0, 0, 0}, FirstObjectID},
+		{"unexpected parameter", [][]byte{{OLCPNext, 0x00}}, []byte{OLCPResponse, OLCPNext, OLCPInvalidParameter}, FirstObjectID},
+		{"unsupported opcode", [][]byte{{0x06}}, []byte{OLCPResponse, 0x06, OLCPOpCodeNotSupported}, FirstObjectID},
+		{"empty request", [][]byte{{}}, []byte{OLCPResponse, 0x00, OLCPInvalidParameter}, FirstObjectID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent [][]byte
+			var deleted bool
+			s := newTestServer(&sent, &deleted, nil)
+
+			var response []byte
+			for _, request := range tt.requests {
+				response = s.ListControl(request)
+			}
+			if !bytes.Equal(response, tt.response) {
+				t.Fatalf("response % x, want % x", response, tt.response)
+			}
+			if id := s.Current().ID; id != tt.current {
+				t.Fatalf("current object 0x%x, want 0x%x", id, tt.current)
+			}
+		})
+	}
+}
+
+func TestListControlWithoutObjects(t *testing.T) {
+	s := NewServer(func([]byte) {}, func() int { return 8 })
+
+	if response := s.ListControl([]byte{OLCPFirst}); !bytes.Equal(response, []byte{OLCPResponse, OLCPFirst, OLCPNoObject}) {
+		t.Fatalf("first: % x", response)
+	}
+	if response := s.ListControl([]byte{OLCPNumberOfObjects}); !bytes.Equal(response, []byte{OLCPResponse, OLCPNumberOfObjects, OLCPSuccess, 0, 0, 0, 0}) {
+		t.Fatalf("number of objects: % x", response)
+	}
+	if response := s.ActionControl([]byte{OACPRead, 0, 0, 0, 0, 0, 0, 0, 0}); !bytes.Equal(response, []byte{OACPResponse, OACPRead, OACPInvalidObject}) {
+		t.Fatalf("read: % x", response)
+	}
+}
+
+func readRequest(op byte, offset, length uint32) []byte {
+	request := binary.LittleEndian.AppendUint32([]byte{op}, offset)
+	return binary.LittleEndian.AppendUint32(request, length)
+}
+
+func TestActionControl(t *testing.T) {
+	checksum := binary.LittleEndian.AppendUint32([]byte{OACPResponse, OACPCalculateChecksum, OACPSuccess}, crc32.ChecksumIEEE(content[2:12]))
+
+	tests := []struct {
+		name      string
+		object    uint64
+		request   []byte
+		deleteErr error
+		response  []byte
+		sent      []byte
+		deleted   bool
+	}{
+		{"read all", FirstObjectID, readRequest(OACPRead, 0, uint32(len(content))), nil,
+			[]byte{OACPResponse, OACPRead, OACPSuccess}, content, false},
+		{"read range", FirstObjectID, readRequest(OACPRead, 3, 9), nil,
+			[]byte{OACPResponse, OACPRead, OACPSuccess}, content[3:12], false},
+		{"read empty range at the end", FirstObjectID, readRequest(OACPRead, uint32(len(content)), 0), nil,
+			[]byte{OACPResponse, OACPRead, OACPSuccess}, nil, false},
+		{"read past the end", FirstObjectID, readRequest(OACPRead, 16, 5), nil,
+			[]byte{OACPResponse, OACPRead, OACPInvalidParameter}, nil, false},
+		{"read offset past the end", FirstObjectID, readRequest(OACPRead, 21, 0), nil,
+			[]byte{OACPResponse, OACPRead, OACPInvalidParameter}, nil, false},
+		{"read truncated", FirstObjectID, []byte{OACPRead, 0, 0, 0, 0}, nil,
+			[]byte{OACPResponse, OACPRead, OACPInvalidParameter}, nil, false},
+		{"checksum", FirstObjectID, readRequest(OACPCalculateChecksum, 2, 10), nil,
+			checksum, nil, false},
+		{"delete", FirstObjectID + 1, []byte{OACPDelete}, nil,
+			[]byte{OACPResponse, OACPDelete, OACPSuccess}, nil, true},
+		{"delete failing", FirstObjectID + 1, []byte{OACPDelete}, errors.New("busy"),
+			[]byte{OACPResponse, OACPDelete, OACPOperationFailed}, nil, true},
+		{"delete with parameter", FirstObjectID + 1, []byte{OACPDelete, 0x00}, nil,
+			[]byte{OACPResponse, OACPDelete, OACPInvalidParameter}, nil, false},
+		{"delete not permitted", FirstObjectID, []byte{OACPDelete}, nil,
+			[]byte{OACPResponse, OACPDelete, OACPProcedureNotPermitted}, nil, false},
+		{"abort", FirstObjectID, []byte{OACPAbort}, nil,
+			[]byte{OACPResponse, OACPAbort, OACPSuccess}, nil, false},
+		{"unsupported opcode", FirstObjectID, []byte{0x04}, nil,
+			[]byte{OACPResponse, 0x04, OACPOpCodeNotSupported}, nil, false},
+		{"empty request", FirstObjectID, []byte{}, nil,
+			[]byte{OACPResponse, 0x00, OACPInvalidParameter}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent [][]byte
+			var deleted bool
+			s := newTestServer(&sent, &deleted, tt.deleteErr)
+			s.ListControl(goTo(tt.object))
+
+			response := s.ActionControl(tt.request)
+			if !bytes.Equal(response, tt.response) {
+				t.Fatalf("response % x, want % x", response, tt.response)
+			}
+			if got := bytes.Join(sent, nil); !bytes.Equal(got, tt.sent) {
+				t.Fatalf("sent %q, want %q", got, tt.sent)
+			}
+			for _, chunk := range sent {
+				if len(chunk) > 8 {
+					t.Fatalf("chunk of %d bytes exceeds the chunk size", len(chunk))
+				}
+			}
+			if deleted != tt.deleted {
+				t.Fatalf("deleted %v, want %v", deleted, tt.deleted)
+			}
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	var sent [][]byte
+	var deleted bool
+	s := newTestServer(&sent, &deleted, nil)
+
+	m := s.Metadata()
+	if string(m.Name) != "data" || binary.LittleEndian.Uint16(m.Type) != TypeUnspecified ||
+		!bytes.Equal(m.ID, []byte{0x00, 0x01, 0, 0, 0, 0}) || binary.LittleEndian.Uint32(m.Properties) != PropertyRead {
+		t.Fatalf("metadata %+v", m)
+	}
+	if binary.LittleEndian.Uint32(m.Size) != uint32(len(content)) || binary.LittleEndian.Uint32(m.Size[4:]) != uint32(len(content)) {
+		t.Fatalf("size % x", m.Size)
+	}
+
+	s.ListControl([]byte{OLCPLast})
+	if m := s.Metadata(); binary.LittleEndian.Uint32(m.Properties) != PropertyRead|PropertyDelete {
+		t.Fatalf("properties % x", m.Properties)
+	}
+
+	// Size is used instead of reading the contents
+	s.Add(&Object{ID: FirstObjectID + 2, Name: "sized", Read: func() []byte {
+		t.Fatal("read for the size")
+		return nil
+	}, Size: func() int { return 1234 }})
+	s.ListControl(goTo(FirstObjectID + 2))
+	if m := s.Metadata(); binary.LittleEndian.Uint32(m.Size) != 1234 {
+		t.Fatalf("size % x", m.Size)
+	}
+}
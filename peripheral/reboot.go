@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Reset reasons reported by the last reset reason characteristic
+const (
+	resetReasonPowerOn        byte = 0x00 // Process started, or the previous run ended without a requested reset
+	resetReasonSoftware       byte = 0x01 // Reboot command written by the central
+	resetReasonFirmwareUpdate byte = 0x02 // Activated DFU image
+	resetReasonPin            byte = 0x03 // "reboot" console command, stands in for the reset pin
+)
+
+// Reboot command opcodes, written to rebootHandle
+const (
+	rebootCommandReboot byte = 0x01
+)
+
+// Time between a reboot request and the reset, so the write response reaches the central
+const rebootDelay = 500 * time.Millisecond
+
+// Pending reboot, carrying the reset reason
+var rebootRequests = make(chan byte, 1)
+
+func requestReboot(reason byte) {
+	select {
+	case rebootRequests <- reason:
+		println("Reboot requested, reset reason", reason)
+	default:
+		println("Reboot already pending.")
+	}
+}
+
+// Perform requested reboots: drop the connections, persist the reset reason,
+// re-initialise the runtime state from NVM and advertise again.
+func rebootHandler(adv *bluetooth.Advertisement) {
+	for reason := range rebootRequests {
+		time.Sleep(rebootDelay)
+
+		println("Rebooting...")
+		adv.Stop()
+		setAdapterPowerState(false) // Drops every connection, as a reset of the BLE core would
+
+		updateNVM(func(nvm *nvmStruct) {
+			nvm.NextResetReason = reason
+		})
+
+		softReset()
+		boot()
+
+		setAdapterPowerState(true)
+
+		time.Sleep(time.Second * 2) // Wait for the adapter to be ready
+
+		adv.Start()
+		println("Reboot done, advertising again.")
+	}
+}
+
+// Clear the state held in RAM: transfers, the device log and DFU uploads.
+// Sensor records live in flash and are reloaded by boot, the ones staged by a
+// transfer are merged first. Records acknowledged but not deleted are offered
+// again.
+func softReset() {
+	serializedSensorDataMutex.Lock()
+	flushSensorDataStaging()
+	sensorDataInTransfer = false
+	sensorDataSynced = nil
+	sensorDataSelection = sensorDataSelectionStruct{}
+	sensorDataCatalogStart = 0
+	connectionMTU = 0
+	serializedSensorDataMutex.Unlock()
+
+	// Published with the config audit records and boot entry that follow every
+	// soft reset
+	deviceLogMutex.Lock()
+	serializedDeviceLogData = []byte{}
+	deviceLogMutex.Unlock()
+
+	dfuMutex.Lock()
+	dfuTarget = newDFUTarget()
+	publishDFUStatus()
+	dfuMutex.Unlock()
+
+	stopAdvertisingDueToDisconnect = false
+}
+
+// Boot from the simulated NVM: count the boot, report why the device reset
+// and restore the configuration registers, firmware revision and record IDs.
+func boot() {
+	nvm := updateNVM(func(nvm *nvmStruct) {
+		nvm.BootCount++
+		lastResetReason = nvm.NextResetReason
+		nvm.NextResetReason = resetReasonPowerOn
+	})
+
+	restoreConfig(nvm)
+	publishConfigGeneration(nvm)
+
+	bootCount = nvm.BootCount
+	bootCountHandle.Write(ToByteArray(bootCount))
+	lastResetReasonHandle.Write([]byte{lastResetReason})
+
+	if nvm.FirmwareRevision != "" {
+		fwRevision = nvm.FirmwareRevision
+	}
+	fwRevisionHandle.Write([]byte(fwRevision))
+	disFirmwareRevisionHandle.Write([]byte(fwRevision))
+
+	// After a power on every reserved ID may have been used, continue past them
+	recordIDMutex.Lock()
+	if nvm.LastRecordID > recordIDReserved {
+		lastRecordID = nvm.LastRecordID
+		recordIDReserved = nvm.LastRecordID
+	}
+	recordIDMutex.Unlock()
+
+	restoreSensorData()
+
+	deviceLogMutex.Lock()
+	serializedDeviceLogData = nvm.ConfigAudit
+	deviceLogMutex.Unlock()
+
+	message := "Boot " + strconv.FormatUint(uint64(bootCount), 10) + ", reset reason " + strconv.Itoa(int(lastResetReason)) + ", firmware " + fwRevision
+	NewLogHandler(time.Now().UnixMicro(), message)
+	println(message)
+}
@@ -0,0 +1,280 @@
+// Package record implements the framed binary format used for every record the
+// peripheral stores and transfers: sensor events and device log entries.
+//
+// A frame is a fixed 20 byte little endian header followed by the payload:
+//
+//	offset size field
+//	0      2    magic (0x4D53, "SM" on the wire)
+//	2      1    format version
+//	3      1    record type
+//	4      2    flags
+//	6      4    record ID
+//	10     4    payload length
+//	14     4    CRC-32 (IEEE) over header bytes [0:14] and the payload
+//	18     2    reserved, always zero
+//
+// The payload layouts are the ones the peripheral used before framing was
+// introduced, so a decoder only has to learn the header.
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"unicode/utf8"
+)
+
+const (
+	Magic      uint16 = 0x4D53
+	Version    uint8  = 1
+	HeaderSize        = 20
+
+	// Payload header sizes of the individual record types.
+	SensorHeaderSize = 16
+	LogHeaderSize    = 10
+
+	// Bytes per sample written by the sensor. Samples are little endian unsigned.
+	SampleWidth = 2
+
+	// The payloads hold the samples and message length in 16 bits. Longer ones
+	// are cut to these lengths, whole samples and characters, and the frame is
+	// flagged FlagTruncated.
+	MaxSamplesLength = math.MaxUint16 - math.MaxUint16%SampleWidth
+	MaxMessageLength = math.MaxUint16
+)
+
+// Type identifies the payload carried by a frame.
+type Type uint8
+
+const (
+	TypeSensor Type = 1
+	TypeLog    Type = 2
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeSensor:
+		return "sensor"
+	case TypeLog:
+		return "log"
+	default:
+		return fmt.Sprintf("type(%d)", uint8(t))
+	}
+}
+
+// Flag bits of the header flags field.
+const (
+	// FlagTruncated marks a payload the producer had to cut short.
+	FlagTruncated uint16 = 1 << 0
+)
+
+var (
+	ErrShort    = errors.New("record: short buffer")
+	ErrMagic    = errors.New("record: bad magic")
+	ErrVersion  = errors.New("record: unsupported version")
+	ErrChecksum = errors.New("record: checksum mismatch")
+	ErrPayload  = errors.New("record: malformed payload")
+)
+
+// Header is the decoded frame header.
+type Header struct {
+	Version  uint8
+	Type     Type
+	Flags    uint16
+	ID       uint32
+	Length   uint32
+	Checksum uint32
+}
+
+// Frame is a single decoded record. Payload aliases the decoded buffer.
+type Frame struct {
+	Header
+	Payload []byte
+}
+
+// Sensor is the payload of a TypeSensor record.
+type Sensor struct {
+	Timestamp  int64 // Start of the event, unix microseconds
+	TimeLength uint32
+	ODR        uint16
+	Samples    []byte
+}
+
+// Log is the payload of a TypeLog record.
+type Log struct {
+	Timestamp int64 // Unix microseconds
+	Message   string
+}
+
+// Append encodes a frame with the given type, flags, ID and payload and
+// appends it to dst.
+func Append(dst []byte, typ Type, flags uint16, id uint32, payload []byte) []byte {
+	var header [HeaderSize]byte
+	binary.LittleEndian.PutUint16(header[0:2], Magic)
+	header[2] = Version
+	header[3] = byte(typ)
+	binary.LittleEndian.PutUint16(header[4:6], flags)
+	binary.LittleEndian.PutUint32(header[6:10], id)
+	binary.LittleEndian.PutUint32(header[10:14], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[14:18], checksum(header[:14], payload))
+
+	dst = append(dst, header[:]...)
+	return append(dst, payload...)
+}
+
+// AppendSensor encodes a sensor event as a TypeSensor frame. Samples beyond
+// MaxSamplesLength are cut and the frame flagged FlagTruncated.
+func AppendSensor(dst []byte, id uint32, flags uint16, s Sensor) []byte {
+	if len(s.Samples) > MaxSamplesLength {
+		flags |= FlagTruncated
+	}
+	return Append(dst, TypeSensor, flags, id, s.MarshalPayload())
+}
+
+// AppendLog encodes a log entry as a TypeLog frame. A message longer than
+// MaxMessageLength is cut and the frame flagged FlagTruncated.
+func AppendLog(dst []byte, id uint32, flags uint16, l Log) []byte {
+	if len(l.Message) > MaxMessageLength {
+		flags |= FlagTruncated
+	}
+	return Append(dst, TypeLog, flags, id, l.MarshalPayload())
+}
+
+// Values returns the samples of a sensor record. A trailing odd byte is ignored.
+func (s Sensor) Values() []uint16 {
+	values := make([]uint16, len(s.Samples)/SampleWidth)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint16(s.Samples[i*SampleWidth:])
+	}
+	return values
+}
+
+// MarshalPayload returns the payload bytes of a sensor record, the samples
+// cut to MaxSamplesLength.
+func (s Sensor) MarshalPayload() []byte {
+	s.Samples = s.Samples[:min(len(s.Samples), MaxSamplesLength)]
+	buffer := make([]byte, SensorHeaderSize, SensorHeaderSize+len(s.Samples))
+	binary.LittleEndian.PutUint64(buffer[0:8], uint64(s.Timestamp))
+	binary.LittleEndian.PutUint32(buffer[8:12], s.TimeLength)
+	binary.LittleEndian.PutUint16(buffer[12:14], s.ODR)
+	binary.LittleEndian.PutUint16(buffer[14:16], uint16(len(s.Samples)))
+	return append(buffer, s.Samples...)
+}
+
+// MarshalPayload returns the payload bytes of a log record, the message cut
+// to MaxMessageLength.
+func (l Log) MarshalPayload() []byte {
+	l.Message = truncateMessage(l.Message)
+	buffer := make([]byte, LogHeaderSize, LogHeaderSize+len(l.Message))
+	binary.LittleEndian.PutUint64(buffer[0:8], uint64(l.Timestamp))
+	binary.LittleEndian.PutUint16(buffer[8:10], uint16(len(l.Message)))
+	return append(buffer, l.Message...)
+}
+
+// DecodeHeader parses and validates the header at the start of b. It does not
+// check the payload.
+func DecodeHeader(b []byte) (Header, error) {
+	if len(b) < HeaderSize {
+		return Header{}, ErrShort
+	}
+	if binary.LittleEndian.Uint16(b[0:2]) != Magic {
+		return Header{}, ErrMagic
+	}
+	h := Header{
+		Version:  b[2],
+		Type:     Type(b[3]),
+		Flags:    binary.LittleEndian.Uint16(b[4:6]),
+		ID:       binary.LittleEndian.Uint32(b[6:10]),
+		Length:   binary.LittleEndian.Uint32(b[10:14]),
+		Checksum: binary.LittleEndian.Uint32(b[14:18]),
+	}
+	if h.Version != Version {
+		return h, fmt.Errorf("%w: %d", ErrVersion, h.Version)
+	}
+	return h, nil
+}
+
+// Decode parses the frame at the start of b and returns it together with the
+// number of bytes it occupies.
+func Decode(b []byte) (Frame, int, error) {
+	h, err := DecodeHeader(b)
+	if err != nil {
+		return Frame{Header: h}, 0, err
+	}
+	size := HeaderSize + int(h.Length)
+	if len(b) < size {
+		return Frame{Header: h}, 0, ErrShort
+	}
+	payload := b[HeaderSize:size]
+	if checksum(b[:14], payload) != h.Checksum {
+		return Frame{Header: h}, 0, ErrChecksum
+	}
+	return Frame{Header: h, Payload: payload}, size, nil
+}
+
+// Sensor parses the payload of a TypeSensor frame.
+func (f Frame) Sensor() (Sensor, error) {
+	if f.Type != TypeSensor {
+		return Sensor{}, fmt.Errorf("%w: %v is not a sensor record", ErrPayload, f.Type)
+	}
+	return ParseSensor(f.Payload)
+}
+
+// Log parses the payload of a TypeLog frame.
+func (f Frame) Log() (Log, error) {
+	if f.Type != TypeLog {
+		return Log{}, fmt.Errorf("%w: %v is not a log record", ErrPayload, f.Type)
+	}
+	return ParseLog(f.Payload)
+}
+
+// ParseSensor parses a sensor payload.
+func ParseSensor(p []byte) (Sensor, error) {
+	if len(p) < SensorHeaderSize {
+		return Sensor{}, fmt.Errorf("%w: sensor payload is %d bytes", ErrPayload, len(p))
+	}
+	dataLength := int(binary.LittleEndian.Uint16(p[14:16]))
+	if len(p) != SensorHeaderSize+dataLength {
+		return Sensor{}, fmt.Errorf("%w: sensor data length %d, payload holds %d", ErrPayload, dataLength, len(p)-SensorHeaderSize)
+	}
+	return Sensor{
+		Timestamp:  int64(binary.LittleEndian.Uint64(p[0:8])),
+		TimeLength: binary.LittleEndian.Uint32(p[8:12]),
+		ODR:        binary.LittleEndian.Uint16(p[12:14]),
+		Samples:    p[SensorHeaderSize:],
+	}, nil
+}
+
+// ParseLog parses a log payload.
+func ParseLog(p []byte) (Log, error) {
+	if len(p) < LogHeaderSize {
+		return Log{}, fmt.Errorf("%w: log payload is %d bytes", ErrPayload, len(p))
+	}
+	messageLength := int(binary.LittleEndian.Uint16(p[8:10]))
+	if len(p) != LogHeaderSize+messageLength {
+		return Log{}, fmt.Errorf("%w: log message length %d, payload holds %d", ErrPayload, messageLength, len(p)-LogHeaderSize)
+	}
+	return Log{
+		Timestamp: int64(binary.LittleEndian.Uint64(p[0:8])),
+		Message:   string(p[LogHeaderSize:]),
+	}, nil
+}
+
+// Cut a message to MaxMessageLength bytes without splitting a UTF-8 character.
+func truncateMessage(message string) string {
+	if len(message) <= MaxMessageLength {
+		return message
+	}
+	n := MaxMessageLength
+	for n > 0 && !utf8.RuneStart(message[n]) {
+		n--
+	}
+	return message[:n]
+}
+
+func checksum(header, payload []byte) uint32 {
+	crc := crc32.ChecksumIEEE(header)
+	return crc32.Update(crc, crc32.IEEETable, payload)
+}
@@ -0,0 +1,157 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+var goldenSensor = Sensor{
+	Timestamp:  1_730_000_000_123_456,
+	TimeLength: 3600,
+	ODR:        2500,
+	Samples:    []byte{0x01, 0x02, 0xff, 0x03, 0x10, 0x00},
+}
+
+var goldenLog = Log{
+	Timestamp: 1_730_000_000_654_321,
+	Message:   "New sensor data received",
+}
+
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s mismatch\n got: % x\nwant: % x", name, got, want)
+	}
+}
+
+func TestGolden(t *testing.T) {
+	golden(t, "sensor.golden", AppendSensor(nil, 7, 0, goldenSensor))
+	golden(t, "log.golden", AppendLog(nil, 8, 0, goldenLog))
+}
+
+func TestDecodeGolden(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "sensor.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, n, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) || frame.ID != 7 || frame.Type != TypeSensor {
+		t.Fatalf("unexpected frame %+v, size %d", frame.Header, n)
+	}
+	s, err := frame.Sensor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Timestamp != goldenSensor.Timestamp || s.TimeLength != goldenSensor.TimeLength ||
+		s.ODR != goldenSensor.ODR || !bytes.Equal(s.Samples, goldenSensor.Samples) {
+		t.Fatalf("decoded %+v, want %+v", s, goldenSensor)
+	}
+
+	data, err = os.ReadFile(filepath.Join("testdata", "log.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, _, err = Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := frame.Log()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != goldenLog {
+		t.Fatalf("decoded %+v, want %+v", l, goldenLog)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	valid := AppendSensor(nil, 1, 0, goldenSensor)
+
+	corrupt := bytes.Clone(valid)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	badMagic := bytes.Clone(valid)
+	badMagic[0] = 0
+
+	badVersion := bytes.Clone(valid)
+	badVersion[2] = Version + 1
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"short header", valid[:HeaderSize-1], ErrShort},
+		{"short payload", valid[:len(valid)-1], ErrShort},
+		{"checksum", corrupt, ErrChecksum},
+		{"magic", badMagic, ErrMagic},
+		{"version", badVersion, ErrVersion},
+	} {
+		if _, _, err := Decode(tc.data); !errors.Is(err, tc.err) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestAppendOversized(t *testing.T) {
+	samples := bytes.Repeat([]byte{1}, MaxSamplesLength+3)
+	message := strings.Repeat("a", MaxMessageLength-1) + "µ" // The 2 byte character crosses the limit
+
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		length int // Of the decoded samples or message
+		flags  uint16
+	}{
+		{"sensor", AppendSensor(nil, 1, 0, Sensor{ODR: 2500, Samples: samples}), MaxSamplesLength, FlagTruncated},
+		{"sensor fits", AppendSensor(nil, 1, 0, Sensor{ODR: 2500, Samples: samples[:MaxSamplesLength]}), MaxSamplesLength, 0},
+		{"log", AppendLog(nil, 2, 0, Log{Message: message}), MaxMessageLength - 1, FlagTruncated},
+		{"log fits", AppendLog(nil, 2, 0, Log{Message: message[:MaxMessageLength-1]}), MaxMessageLength - 1, 0},
+	} {
+		frame, n, err := Decode(tc.data)
+		if err != nil || n != len(tc.data) {
+			t.Fatalf("%s: decoded %d of %d bytes: %v", tc.name, n, len(tc.data), err)
+		}
+		if frame.Flags != tc.flags {
+			t.Errorf("%s: flags 0x%04X, want 0x%04X", tc.name, frame.Flags, tc.flags)
+		}
+
+		var length int
+		if frame.Type == TypeSensor {
+			s, err := frame.Sensor()
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			length = len(s.Samples)
+		} else {
+			l, err := frame.Log()
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			length = len(l.Message)
+		}
+		if length != tc.length {
+			t.Errorf("%s: length %d, want %d", tc.name, length, tc.length)
+		}
+	}
+}
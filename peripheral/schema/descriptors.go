@@ -0,0 +1,65 @@
+package schema
+
+import "encoding/binary"
+
+// Descriptor UUIDs.
+const (
+	UserDescriptionUUID    uint16 = 0x2901
+	PresentationFormatUUID uint16 = 0x2904
+)
+
+// Format field of the presentation format descriptor.
+var presentationFormats = map[DataType]byte{
+	Bool:   0x01,
+	Uint8:  0x04,
+	Uint16: 0x06,
+	Uint32: 0x08,
+	Uint64: 0x0A,
+	Int8:   0x0C,
+	Int16:  0x0E,
+	Int32:  0x10,
+	Int64:  0x12,
+	String: 0x19, // utf8s
+	Bytes:  0x1B, // struct, opaque
+}
+
+// Bluetooth SIG unit and decimal exponent of the schema units.
+var presentationUnits = map[string]struct {
+	unit     uint16
+	exponent int8
+}{
+	"%":   {0x27AD, 0},  // percentage
+	"dBm": {0x27C3, 0},  // decibel
+	"s":   {0x2703, 0},  // second
+	"ms":  {0x2703, -3}, // second, 10^-3
+	"us":  {0x2703, -6}, // second, 10^-6
+	"Hz":  {0x2722, 0},  // hertz
+}
+
+const (
+	unitless               uint16 = 0x2700
+	namespaceBluetooth     byte   = 0x01
+	descriptionUnknown     uint16 = 0x0000
+	presentationFormatSize        = 7
+)
+
+// UserDescription returns the value of the 0x2901 descriptor: the name.
+func (c Characteristic) UserDescription() []byte {
+	return []byte(c.Name)
+}
+
+// PresentationFormat returns the value of the 0x2904 descriptor: format,
+// exponent, unit, namespace and description. Units without a Bluetooth SIG
+// equivalent, such as bytes or 0.625 ms, are presented as unitless.
+func (c Characteristic) PresentationFormat() []byte {
+	unit, ok := presentationUnits[c.Unit]
+	if !ok {
+		unit.unit = unitless
+	}
+
+	value := make([]byte, 0, presentationFormatSize)
+	value = append(value, presentationFormats[c.DataType], byte(unit.exponent))
+	value = binary.LittleEndian.AppendUint16(value, unit.unit)
+	value = append(value, namespaceBluetooth)
+	return binary.LittleEndian.AppendUint16(value, descriptionUnknown)
+}
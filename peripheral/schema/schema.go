@@ -0,0 +1,252 @@
+// Package schema loads assets/ble_characteristics.json, the characteristic
+// description shared by the app and the peripheral.
+//
+// The app reads "characteristic_mappings", keyed by characteristic UUID: name,
+// description, data type, unit and the editing options of its UI. The
+// peripheral additionally reads the "key" of a mapping, binding it to the
+// characteristic implementing it, and "services", which groups the
+// characteristics into services.
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+
+	"go-ble/codec"
+
+	"github.com/google/uuid"
+)
+
+// DataType is the value encoding of a characteristic. Integers are little endian.
+type DataType string
+
+const (
+	Bool   DataType = "bool"
+	Uint8  DataType = "uint8"
+	Int8   DataType = "int8"
+	Uint16 DataType = "uint16"
+	Int16  DataType = "int16"
+	Uint32 DataType = "uint32"
+	Int32  DataType = "int32"
+	Uint64 DataType = "uint64"
+	Int64  DataType = "int64"
+	String DataType = "string"
+	Bytes  DataType = "bytes"
+)
+
+var dataTypeSizes = map[DataType]int{
+	Bool: 1, Uint8: 1, Int8: 1, Uint16: 2, Int16: 2, Uint32: 4, Int32: 4, Uint64: 8, Int64: 8, String: 0, Bytes: 0,
+}
+
+// Size returns the encoded size in bytes, 0 for variable length types.
+func (t DataType) Size() int {
+	return dataTypeSizes[t]
+}
+
+// Signed reports whether the type is a signed integer.
+func (t DataType) Signed() bool {
+	return strings.HasPrefix(string(t), "int")
+}
+
+// Integer reports whether the type is an integer, bool included.
+func (t DataType) Integer() bool {
+	return t.Size() > 0
+}
+
+// Bounds returns the smallest and largest value of an integer type.
+func (t DataType) Bounds() (lower, upper float64) {
+	if t == Bool {
+		return 0, 1
+	}
+	bits := float64(8 * t.Size())
+	if t.Signed() {
+		return -math.Exp2(bits - 1), math.Exp2(bits-1) - 1
+	}
+	return 0, math.Exp2(bits) - 1
+}
+
+var dataTypeCodecs = map[DataType]codec.Codec{
+	Bool: codec.B, Uint8: codec.U8, Int8: codec.I8, Uint16: codec.U16, Int16: codec.I16,
+	Uint32: codec.U32, Int32: codec.I32, Uint64: codec.U64, Int64: codec.I64, String: codec.UTF8, Bytes: codec.Raw,
+}
+
+// Codec returns the codec encoding values of the type.
+func (t DataType) Codec() codec.Codec {
+	return dataTypeCodecs[t]
+}
+
+// Valid reports whether the type is known.
+func (t DataType) Valid() bool {
+	_, ok := dataTypeSizes[t]
+	return ok
+}
+
+// Editing options of the app.
+const (
+	EditingNone      = ""          // Read only
+	EditingWrite     = "write"     // Free input within Range
+	EditingSelection = "selection" // One of SelectionOptions
+)
+
+// Characteristic is one entry of "characteristic_mappings".
+type Characteristic struct {
+	UUID             string    `json:"-"`
+	Key              string    `json:"key,omitempty"`
+	Name             string    `json:"name"`
+	Description      string    `json:"description"`
+	DataType         DataType  `json:"data_type"`
+	Unit             string    `json:"unit,omitempty"`
+	Editing          string    `json:"editing,omitempty"`
+	SelectionOptions []float64 `json:"selection_options,omitempty"`
+	Range            []float64 `json:"range,omitempty"`
+	Step             float64   `json:"step,omitempty"` // Writable values are min + n * step, 0 allows every value
+}
+
+// Writable reports whether the app offers to write the characteristic.
+func (c Characteristic) Writable() bool {
+	return c.Editing != EditingNone
+}
+
+// Service groups characteristics, listed by UUID.
+type Service struct {
+	UUID            string   `json:"uuid"`
+	Name            string   `json:"name"`
+	Characteristics []string `json:"characteristics"`
+}
+
+// Schema is the parsed file. Characteristics are sorted by UUID.
+type Schema struct {
+	Services        []Service
+	Characteristics []Characteristic
+}
+
+type file struct {
+	Services        []Service                 `json:"services"`
+	Characteristics map[string]Characteristic `json:"characteristic_mappings"`
+}
+
+// Load reads and validates a schema file.
+func Load(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Parse decodes and validates a schema.
+func Parse(data []byte) (*Schema, error) {
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.Characteristics == nil {
+		return nil, errors.New("no characteristic_mappings")
+	}
+
+	s := &Schema{Services: f.Services}
+	for id, c := range f.Characteristics {
+		c.UUID = id
+		s.Characteristics = append(s.Characteristics, c)
+	}
+	slices.SortFunc(s.Characteristics, func(a, b Characteristic) int {
+		return strings.Compare(a.UUID, b.UUID)
+	})
+
+	return s, s.validate()
+}
+
+func (s *Schema) validate() error {
+	var errs []error
+
+	keys := map[string]string{}
+	for _, c := range s.Characteristics {
+		if err := validUUID(c.UUID); err != nil {
+			errs = append(errs, fmt.Errorf("characteristic %s (%s): %w", c.UUID, c.Name, err))
+		}
+		if !c.DataType.Valid() {
+			errs = append(errs, fmt.Errorf("characteristic %s (%s): unknown data_type %q", c.UUID, c.Name, c.DataType))
+		}
+		switch c.Editing {
+		case EditingNone:
+		case EditingWrite:
+			if len(c.Range) != 2 || c.Range[0] > c.Range[1] {
+				errs = append(errs, fmt.Errorf("characteristic %s (%s): editing write needs a [min, max] range", c.UUID, c.Name))
+			}
+		case EditingSelection:
+			if len(c.SelectionOptions) == 0 {
+				errs = append(errs, fmt.Errorf("characteristic %s (%s): editing selection needs selection_options", c.UUID, c.Name))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("characteristic %s (%s): unknown editing %q", c.UUID, c.Name, c.Editing))
+		}
+		if c.DataType.Integer() {
+			lower, upper := c.DataType.Bounds()
+			for _, n := range slices.Concat(c.Range, c.SelectionOptions) {
+				if n < lower || n > upper {
+					errs = append(errs, fmt.Errorf("characteristic %s (%s): %v doesn't fit in %s [%v, %v]", c.UUID, c.Name, n, c.DataType, lower, upper))
+				}
+			}
+		}
+		if c.Step < 0 {
+			errs = append(errs, fmt.Errorf("characteristic %s (%s): negative step", c.UUID, c.Name))
+		}
+		if c.Key == "" {
+			continue
+		}
+		if other, ok := keys[c.Key]; ok {
+			errs = append(errs, fmt.Errorf("characteristic %s (%s): key %q is already used by %s", c.UUID, c.Name, c.Key, other))
+		}
+		keys[c.Key] = c.UUID
+	}
+
+	grouped := map[string]string{}
+	for _, service := range s.Services {
+		if err := validUUID(service.UUID); err != nil {
+			errs = append(errs, fmt.Errorf("service %s (%s): %w", service.UUID, service.Name, err))
+		}
+		for _, id := range service.Characteristics {
+			if _, ok := s.Characteristic(id); !ok {
+				errs = append(errs, fmt.Errorf("service %s (%s): no characteristic mapping for %s", service.UUID, service.Name, id))
+			}
+			if other, ok := grouped[id]; ok {
+				errs = append(errs, fmt.Errorf("service %s (%s): %s is already part of service %s", service.UUID, service.Name, id, other))
+			}
+			grouped[id] = service.UUID
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// The app matches characteristics by their lower case string form.
+func validUUID(id string) error {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return err
+	}
+	if parsed.String() != id {
+		return fmt.Errorf("not in canonical lower case form, expected %s", parsed)
+	}
+	return nil
+}
+
+// Characteristic returns the mapping of a characteristic UUID.
+func (s *Schema) Characteristic(id string) (Characteristic, bool) {
+	i, ok := slices.BinarySearchFunc(s.Characteristics, id, func(c Characteristic, id string) int {
+		return strings.Compare(c.UUID, id)
+	})
+	if !ok {
+		return Characteristic{}, false
+	}
+	return s.Characteristics[i], true
+}
@@ -0,0 +1,44 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping string
+		want    string
+	}{
+		{"range beyond uint8", `{"name": "A", "data_type": "uint8", "editing": "write", "range": [0, 1000]}`, "1000 doesn't fit in uint8 [0, 255]"},
+		{"range beyond uint16", `{"name": "A", "data_type": "uint16", "editing": "write", "range": [0, 3600000]}`, "3.6e+06 doesn't fit in uint16 [0, 65535]"},
+		{"negative unsigned", `{"name": "A", "data_type": "uint16", "editing": "write", "range": [-1, 10]}`, "-1 doesn't fit in uint16"},
+		{"option beyond int8", `{"name": "A", "data_type": "int8", "editing": "selection", "selection_options": [-3, 200]}`, "200 doesn't fit in int8 [-128, 127]"},
+		{"write without range", `{"name": "A", "data_type": "uint8", "editing": "write"}`, "needs a [min, max] range"},
+		{"unknown type", `{"name": "A", "data_type": "uint24"}`, `unknown data_type "uint24"`},
+		{"upper case UUID", `{"name": "A", "data_type": "uint8"}`, "canonical lower case"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := "0000abcd-0000-1000-8000-00805f9b34fb"
+			if test.name == "upper case UUID" {
+				id = strings.ToUpper(id)
+			}
+			_, err := Parse([]byte(`{"characteristic_mappings": {"` + id + `": ` + test.mapping + `}}`))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestParseAcceptsTypeBounds(t *testing.T) {
+	_, err := Parse([]byte(`{"characteristic_mappings": {
+		"0000abcd-0000-1000-8000-00805f9b34fb": {"name": "A", "data_type": "uint16", "editing": "write", "range": [0, 65535]},
+		"0000abce-0000-1000-8000-00805f9b34fb": {"name": "B", "data_type": "int8", "editing": "selection", "selection_options": [-128, 127]}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"time"
+
+	"go-ble/decode"
+)
+
+// Sensor data request opcodes, the first byte written to sensorDataRequestHandle.
+const (
+	sensorDataRequestAll         byte = 0x00 // Select every stored record
+	sensorDataRequestRecords     byte = 0x01 // Followed by one or more uint32 record IDs
+	sensorDataRequestTimeRange   byte = 0x02 // Followed by int64 from and to, unix microseconds, inclusive
+	sensorDataRequestCatalogPage byte = 0x03 // Followed by the uint32 record ID the catalog starts at
+)
+
+// Sensor data acknowledge opcodes, the first byte written to sensorDataAckHandle.
+// Both are followed by one or more uint32 record IDs.
+const (
+	sensorDataAckRecords    byte = 0x01 // Records the central received intact
+	sensorDataDeleteRecords byte = 0x02 // Synced records the central wants deleted
+)
+
+// Catalog layout: uint16 total record count followed by one entry per record
+// - uint32 ID, int64 timestamp, uint32 event length, uint16 ODR, uint16 data length.
+const (
+	sensorDataCatalogEntrySize  = 20
+	sensorDataCatalogMaxEntries = (512 - 2) / sensorDataCatalogEntrySize // Fits a single long read
+)
+
+// Records selected for transfer. With neither ids nor timeRange set every record is selected.
+type sensorDataSelectionStruct struct {
+	ids       []uint32
+	timeRange bool
+	from      int64
+	to        int64
+}
+
+func (selection sensorDataSelectionStruct) matches(r decode.Record) bool {
+	switch {
+	case selection.ids != nil:
+		return slices.Contains(selection.ids, r.ID)
+	case selection.timeRange:
+		return r.Sensor.Timestamp >= selection.from && r.Sensor.Timestamp <= selection.to
+	default:
+		return true
+	}
+}
+
+// Parse a write to sensorDataRequestHandle. The selection is empty for catalog page requests.
+func parseSensorDataRequest(value []byte) (op byte, selection sensorDataSelectionStruct, ok bool) {
+	if len(value) == 0 {
+		return 0, selection, false
+	}
+
+	op, args := value[0], value[1:]
+	switch op {
+	case sensorDataRequestAll:
+		return op, selection, len(args) == 0
+	case sensorDataRequestRecords:
+		if len(args) == 0 || len(args)%4 != 0 {
+			return op, selection, false
+		}
+		selection.ids = []uint32{}
+		for i := 0; i < len(args); i += 4 {
+			selection.ids = append(selection.ids, binary.LittleEndian.Uint32(args[i:]))
+		}
+		return op, selection, true
+	case sensorDataRequestTimeRange:
+		if len(args) != 16 {
+			return op, selection, false
+		}
+		selection.timeRange = true
+		selection.from = int64(binary.LittleEndian.Uint64(args[0:8]))
+		selection.to = int64(binary.LittleEndian.Uint64(args[8:16]))
+		return op, selection, selection.from <= selection.to
+	case sensorDataRequestCatalogPage:
+		return op, selection, len(args) == 4
+	}
+
+	return op, selection, false
+}
+
+// Parse a write to sensorDataAckHandle.
+func parseSensorDataAck(value []byte) (op byte, ids []uint32, ok bool) {
+	if len(value) < 5 || (len(value)-1)%4 != 0 {
+		return 0, nil, false
+	}
+
+	op = value[0]
+	for i := 1; i < len(value); i += 4 {
+		ids = append(ids, binary.LittleEndian.Uint32(value[i:]))
+	}
+	return op, ids, op == sensorDataAckRecords || op == sensorDataDeleteRecords
+}
+
+// Decode the sensor records of a serialized buffer.
+func sensorRecords(data []byte) []decode.Record {
+	records, errs := decode.All(data)
+	for _, err := range errs {
+		println("Skipping damaged sensor data:", err.Error())
+	}
+
+	return slices.DeleteFunc(records, func(r decode.Record) bool {
+		return r.Sensor == nil
+	})
+}
+
+// Decode a snapshot of the sensor records currently in memory, including the
+// ones staged while a transfer is running.
+func storedSensorRecords() []decode.Record {
+	serializedSensorDataMutex.Lock()
+	data := slices.Concat(serializedSensorData, sensorDataStaging)
+	serializedSensorDataMutex.Unlock()
+
+	return sensorRecords(data)
+}
+
+// A record in the transfer buffer, end is its offset past the last byte.
+type sensorDataTransferRecord struct {
+	id  uint32
+	end int
+}
+
+// Sensor records in serializedSensorData, aliasing it. Caller must hold serializedSensorDataMutex.
+func storedSensorRecordsLocked() []decode.Record {
+	return sensorRecords(serializedSensorData)
+}
+
+// Rebuild the catalog characteristic. Caller must hold serializedSensorDataMutex.
+func updateSensorDataCatalog() {
+	sensorDataCatalog = sensorDataCatalogPage(storedSensorRecordsLocked(), sensorDataCatalogStart)
+	sensorDataCatalogHandle.Write(sensorDataCatalog)
+}
+
+// The catalog page of the records with an ID of at least start.
+func sensorDataCatalogPage(records []decode.Record, start uint32) []byte {
+	catalog := binary.LittleEndian.AppendUint16(nil, uint16(len(records)))
+	entries := 0
+	for _, r := range records {
+		if r.ID < start {
+			continue
+		}
+		if entries == sensorDataCatalogMaxEntries {
+			break
+		}
+		catalog = binary.LittleEndian.AppendUint32(catalog, r.ID)
+		catalog = binary.LittleEndian.AppendUint64(catalog, uint64(r.Sensor.Timestamp))
+		catalog = binary.LittleEndian.AppendUint32(catalog, r.Sensor.TimeLength)
+		catalog = binary.LittleEndian.AppendUint16(catalog, r.Sensor.ODR)
+		catalog = binary.LittleEndian.AppendUint16(catalog, uint16(len(r.Sensor.Samples)))
+		entries++
+	}
+	return catalog
+}
+
+// Copy the selected records into the transfer buffer and publish its first
+// chunk. Caller must hold serializedSensorDataMutex.
+func startSensorDataTransfer() {
+	sensorDataTransfer = []byte{}
+	sensorDataTransferRecords = []sensorDataTransferRecord{}
+	sensorDataTransferDelivered = 0
+	sensorDataStream = sensorDataStreamStruct{}
+
+	for _, r := range storedSensorRecordsLocked() {
+		if !sensorDataSelection.matches(r) {
+			continue
+		}
+		sensorDataTransfer = append(sensorDataTransfer, serializedSensorData[r.Offset:r.Offset+r.Size]...)
+		sensorDataTransferRecords = append(sensorDataTransferRecords, sensorDataTransferRecord{
+			id:  r.ID,
+			end: len(sensorDataTransfer),
+		})
+	}
+
+	// The central must confirm this digest before confirm 0x01 clears anything
+	sensorDataDigest = sha256.Sum256(sensorDataTransfer)
+	sensorDataDigestHandle.Write(sensorDataDigest[:])
+	sensorDataDigestVerified = false
+
+	writeSensorDataChunk()
+}
+
+// ATT limits used for chunk sizing. A notification carries at most MTU-3 bytes
+// and an attribute value is at most 512 bytes long.
+const (
+	defaultATTMTU      = 23
+	attNotifyHeader    = 3
+	maxAttributeLength = 512
+	minTransferChunk   = defaultATTMTU - attNotifyHeader
+	maxTransferChunk   = maxAttributeLength
+)
+
+// Size of a sensor data chunk. It follows the negotiated MTU so that every
+// notification fits in a single packet, and falls back to the preferred chunk
+// size while the MTU is unknown.
+func sensorDataChunkSize() int {
+	if connectionMTU != 0 {
+		return min(int(connectionMTU)-attNotifyHeader, maxTransferChunk)
+	}
+	return sensorDataMaxTransferChunk
+}
+
+// Publish the chunk at the start of the transfer buffer.
+func writeSensorDataChunk() {
+	if sensorDataStream.active {
+		return
+	}
+
+	end := min(len(sensorDataTransfer), sensorDataChunkSize())
+	serializedSensorDataRange = []int{0, end}
+	sensorDataHandle.Write(sensorDataTransfer[:end])
+}
+
+// Handle a write to the confirm read characteristic: 0x00 advances to the next
+// chunk, 0x01 ends the transfer. The transfer streams a copy of the selected
+// records. Sensor data arriving until confirm 0x01 is staged and merged into
+// memory once the transfer ends. Caller must hold serializedSensorDataMutex.
+func confirmSensorDataRead(offset int, value []byte) {
+
+	if offset != 0 || len(value) != 1 {
+		println("Bad ConfirmRead value: ", value)
+		return
+	}
+
+	// The stream owns the transfer until it completes or is aborted
+	if sensorDataStream.active {
+		println("Confirm read value", value[0], "refused while a stream is active.")
+		return
+	}
+
+	// Nothing is deleted unless the central proves it got the whole transfer.
+	// Checked before the transfer state changes, a refused confirm doesn't
+	// start staging new sensor data.
+	if value[0] == 0x01 && len(sensorDataTransferRecords) > 0 && !sensorDataDigestVerified {
+		println("Confirm read value set to:", value[0], "but the transfer digest isn't confirmed. Keeping all data.")
+		return
+	}
+
+	sensorDataInTransfer = true
+	sensorDataTransferActivity = time.Now()
+
+	confirmReadValue = value
+
+	if confirmReadValue[0] == 0x01 {
+		println("Confirm read value set to:", confirmReadValue[0], "resetting all values...")
+
+		clearTransfer := func() {
+			sensorDataInTransfer = false
+		}
+
+		defer clearTransfer()
+
+		// The last chunk has been read as well. Every record the central received
+		// completely is synced, and deleted if the clear bit is 1 like on the
+		// acknowledge characteristic. A record cut by the chunk boundary is kept.
+		sensorDataTransferDelivered += serializedSensorDataRange[1]
+		delivered := deliveredSensorRecords()
+		acknowledgeSensorRecords(delivered)
+		if sensorDataClearBit == 1 {
+			deleteSyncedSensorRecords(delivered)
+		}
+		flushSensorDataStaging()
+		startSensorDataTransfer()
+
+		clearDeviceLog("Device log cleared after the transfer")
+
+		println("Turning off adapter...")
+
+		stopAdvertisingDueToDisconnect = true
+	} else { // Written 0
+
+		println("Confirm read value set to:", confirmReadValue[0], "changing sensor data buffer...")
+
+		// Advance past the read chunk
+		sensorDataTransferDelivered += serializedSensorDataRange[1]
+		sensorDataTransfer = sensorDataTransfer[serializedSensorDataRange[1]:]
+		writeSensorDataChunk()
+		println("Sensor data buffer changed.")
+
+	}
+}
+
+// IDs of the records the central has read completely in the current transfer.
+func deliveredSensorRecords() []uint32 {
+	delivered := []uint32{}
+	for _, r := range sensorDataTransferRecords {
+		if r.end > sensorDataTransferDelivered {
+			break
+		}
+		delivered = append(delivered, r.id)
+	}
+	return delivered
+}
+
+// Mark records as synced. Only records delivered completely can be acknowledged,
+// the rest are returned as rejected. Caller must hold serializedSensorDataMutex.
+func acknowledgeSensorRecords(ids []uint32) (rejected []uint32) {
+	delivered := deliveredSensorRecords()
+	for _, id := range ids {
+		if !slices.Contains(delivered, id) {
+			rejected = append(rejected, id)
+			continue
+		}
+		if !slices.Contains(sensorDataSynced, id) {
+			sensorDataSynced = append(sensorDataSynced, id)
+		}
+	}
+	return rejected
+}
+
+// Handle an acknowledge write: mark records as synced or delete synced ones.
+// Deleting, with either opcode, needs the transfer digest confirmed by the
+// central like confirm 0x01, otherwise nothing is deleted. Returns the
+// rejected IDs. Caller must hold serializedSensorDataMutex.
+func applySensorDataAck(op byte, ids []uint32) (rejected []uint32) {
+	if op == sensorDataAckRecords {
+		rejected = acknowledgeSensorRecords(ids)
+		if sensorDataClearBit == 1 {
+			if sensorDataDigestVerified {
+				deleteSyncedSensorRecords(ids)
+			} else {
+				println("Acknowledged records kept, the transfer digest isn't confirmed.")
+			}
+		}
+		println("Acknowledged", len(ids)-len(rejected), "sensor records, rejected", len(rejected))
+		return rejected
+	}
+
+	if !sensorDataDigestVerified {
+		println("Deleting", len(ids), "sensor records refused, the transfer digest isn't confirmed.")
+		return ids
+	}
+	rejected = deleteSyncedSensorRecords(ids)
+	println("Deleted", len(ids)-len(rejected), "synced sensor records, rejected", len(rejected))
+	return rejected
+}
+
+// Delete synced records, the rest are kept and returned as rejected.
+// Caller must hold serializedSensorDataMutex.
+func deleteSyncedSensorRecords(ids []uint32) (rejected []uint32) {
+	deleted := []uint32{}
+	for _, id := range ids {
+		if slices.Contains(sensorDataSynced, id) {
+			deleted = append(deleted, id)
+		} else {
+			rejected = append(rejected, id)
+		}
+	}
+
+	if len(deleted) > 0 {
+		deleteSensorRecords(deleted)
+	}
+	return rejected
+}
+
+// Remove records from serializedSensorData. Caller must hold serializedSensorDataMutex.
+func deleteSensorRecords(ids []uint32) {
+	serializedSensorData = withoutSensorRecords(serializedSensorData, ids)
+
+	sensorDataSynced = slices.DeleteFunc(sensorDataSynced, func(id uint32) bool {
+		return slices.Contains(ids, id)
+	})
+
+	updateSensorDataTotals()
+}
+
+// A copy of data without the records with the given IDs. Everything else,
+// damaged spans that don't decode included, is kept in place so it can still
+// be dumped and analysed.
+func withoutSensorRecords(data []byte, ids []uint32) []byte {
+	records, errs := decode.All(data)
+	if len(errs) > 0 {
+		println("Keeping", len(errs), "damaged sensor data spans while deleting records.")
+	}
+
+	kept := []byte{}
+	start := 0
+	for _, r := range records {
+		if !slices.Contains(ids, r.ID) {
+			continue
+		}
+		kept = append(kept, data[start:r.Offset]...)
+		start = r.Offset + r.Size
+	}
+	return append(kept, data[start:]...)
+}
+
+// Load the sensor records from flash, dropping the ones in RAM. Transfers
+// start over with the records reloaded.
+func restoreSensorData() {
+	serializedSensorDataMutex.Lock()
+	defer serializedSensorDataMutex.Unlock()
+
+	serializedSensorData = loadSensorFlash()
+	sensorDataStaging = []byte{}
+	updateSensorDataTotals()
+	startSensorDataTransfer()
+	println("Restored", len(serializedSensorData), "bytes of sensor data from flash.")
+}
+
+// Merge the data staged during a transfer into serializedSensorData.
+// Caller must hold serializedSensorDataMutex.
+func flushSensorDataStaging() {
+	if len(sensorDataStaging) == 0 {
+		return
+	}
+
+	println("Merging", len(sensorDataStaging), "bytes of sensor data staged during the transfer.")
+	serializedSensorData = append(serializedSensorData, sensorDataStaging...)
+	sensorDataStaging = []byte{}
+
+	updateSensorDataTotals()
+}
+
+// Persist the sensor records and publish the memory usage and the catalog.
+// Called after every change. Caller must hold serializedSensorDataMutex.
+func updateSensorDataTotals() {
+	saveSensorFlash(slices.Concat(serializedSensorData, sensorDataStaging))
+
+	inMemory := len(serializedSensorData) + len(sensorDataStaging)
+
+	memoryAllocatedPercentage = uint8((float64(inMemory) / float64(totalMemory)) * 100 / 2) // Fixed calculation for accuracy
+	memoryAllocatedPercentageHandle.Write([]byte{memoryAllocatedPercentage})
+
+	sensorDataTotal = uint32(inMemory)
+	sensorDataTotalHandle.Write(ToByteArray(sensorDataTotal))
+
+	updateSensorDataCatalog()
+
+	// The object size changed
+	objectMetadataChanged()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"go-ble/decode"
+	"go-ble/record"
+)
+
+func TestParseSensorDataRequest(t *testing.T) {
+	timeRange := func(from, to int64) []byte {
+		value := []byte{sensorDataRequestTimeRange}
+		value = binary.LittleEndian.AppendUint64(value, uint64(from))
+		return binary.LittleEndian.AppendUint64(value, uint64(to))
+	}
+
+	tests := []struct {
+		name      string
+		value     []byte
+		op        byte
+		ok        bool
+		ids       []uint32
+		timeRange bool
+	}{
+		{"empty", []byte{}, 0, false, nil, false},
+		{"all", []byte{sensorDataRequestAll}, sensorDataRequestAll, true, nil, false},
+		{"all with arguments", []byte{sensorDataRequestAll, 1}, sensorDataRequestAll, false, nil, false},
+		{"records", []byte{sensorDataRequestRecords, 1, 0, 0, 0, 2, 1, 0, 0}, sensorDataRequestRecords, true, []uint32{1, 258}, false},
+		{"records without IDs", []byte{sensorDataRequestRecords}, sensorDataRequestRecords, false, nil, false},
+		{"records truncated ID", []byte{sensorDataRequestRecords, 1, 0, 0}, sensorDataRequestRecords, false, nil, false},
+		{"time range", timeRange(100, 200), sensorDataRequestTimeRange, true, nil, true},
+		{"time range of an instant", timeRange(100, 100), sensorDataRequestTimeRange, true, nil, true},
+		{"time range reversed", timeRange(200, 100), sensorDataRequestTimeRange, false, nil, true},
+		{"time range truncated", timeRange(100, 200)[:16], sensorDataRequestTimeRange, false, nil, false},
+		{"catalog page", []byte{sensorDataRequestCatalogPage, 5, 0, 0, 0}, sensorDataRequestCatalogPage, true, nil, false},
+		{"catalog page truncated", []byte{sensorDataRequestCatalogPage, 5}, sensorDataRequestCatalogPage, false, nil, false},
+		{"unknown opcode", []byte{0x7f}, 0x7f, false, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op, selection, ok := parseSensorDataRequest(tt.value)
+			if op != tt.op || ok != tt.ok {
+				t.Fatalf("op 0x%02x ok %v, want 0x%02x %v", op, ok, tt.op, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if !slices.Equal(selection.ids, tt.ids) || selection.timeRange != tt.timeRange {
+				t.Fatalf("selection %+v", selection)
+			}
+		})
+	}
+}
+
+func TestSensorDataSelection(t *testing.T) {
+	r := decode.Record{Header: record.Header{ID: 7}, Sensor: &record.Sensor{Timestamp: 150}}
+
+	tests := []struct {
+		name      string
+		selection sensorDataSelectionStruct
+		matches   bool
+	}{
+		{"all", sensorDataSelectionStruct{}, true},
+		{"listed ID", sensorDataSelectionStruct{ids: []uint32{3, 7}}, true},
+		{"other IDs", sensorDataSelectionStruct{ids: []uint32{3}}, false},
+		{"empty ID list", sensorDataSelectionStruct{ids: []uint32{}}, false},
+		{"within the time range", sensorDataSelectionStruct{timeRange: true, from: 100, to: 150}, true},
+		{"before the time range", sensorDataSelectionStruct{timeRange: true, from: 151, to: 200}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.selection.matches(r); got != tt.matches {
+			t.Errorf("%s: matches %v, want %v", tt.name, got, tt.matches)
+		}
+	}
+}
+
+// n sensor records with IDs from 1.
+func testSensorRecords(n int) []decode.Record {
+	var data []byte
+	for i := range n {
+		data = record.AppendSensor(data, uint32(i+1), 0, record.Sensor{
+			Timestamp:  int64(1000 * (i + 1)),
+			TimeLength: 400,
+			ODR:        2500,
+			Samples:    []byte{byte(i), 0, 1, 0, 2, 0},
+		})
+	}
+	records, _ := decode.All(data)
+	return records
+}
+
+func TestSensorDataCatalogPage(t *testing.T) {
+	records := testSensorRecords(sensorDataCatalogMaxEntries + 5)
+
+	tests := []struct {
+		name    string
+		start   uint32
+		first   uint32
+		entries int
+	}{
+		{"first page", 0, 1, sensorDataCatalogMaxEntries},
+		{"second page", sensorDataCatalogMaxEntries + 1, sensorDataCatalogMaxEntries + 1, 5},
+		{"last record", sensorDataCatalogMaxEntries + 5, sensorDataCatalogMaxEntries + 5, 1},
+		{"past the end", sensorDataCatalogMaxEntries + 6, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			catalog := sensorDataCatalogPage(records, tt.start)
+			if len(catalog) > 512 {
+				t.Fatalf("catalog of %d bytes exceeds a long read", len(catalog))
+			}
+			if total := binary.LittleEndian.Uint16(catalog); int(total) != len(records) {
+				t.Fatalf("total %d, want %d", total, len(records))
+			}
+			entries := catalog[2:]
+			if len(entries) != tt.entries*sensorDataCatalogEntrySize {
+				t.Fatalf("%d entry bytes, want %d entries", len(entries), tt.entries)
+			}
+			if tt.entries == 0 {
+				return
+			}
+			if first := binary.LittleEndian.Uint32(entries); first != tt.first {
+				t.Fatalf("first entry %d, want %d", first, tt.first)
+			}
+
+			// ID, timestamp, event length, ODR and data length of the first entry
+			r := records[tt.first-1]
+			if binary.LittleEndian.Uint64(entries[4:]) != uint64(r.Sensor.Timestamp) ||
+				binary.LittleEndian.Uint32(entries[12:]) != r.Sensor.TimeLength ||
+				binary.LittleEndian.Uint16(entries[16:]) != r.Sensor.ODR ||
+				binary.LittleEndian.Uint16(entries[18:]) != uint16(len(r.Sensor.Samples)) {
+				t.Fatalf("entry % x doesn't describe record %d", entries[:sensorDataCatalogEntrySize], r.ID)
+			}
+		})
+	}
+}
+
+func TestWithoutSensorRecordsKeepsDamagedSpans(t *testing.T) {
+	var data []byte
+	data = record.AppendSensor(data, 1, 0, record.Sensor{Timestamp: 100, ODR: 2500, Samples: []byte{1, 0}})
+	damaged := len(data)
+	data = record.AppendSensor(data, 2, 0, record.Sensor{Timestamp: 200, ODR: 2500, Samples: []byte{2, 0}})
+	data[damaged] = 0x00 // Bad magic
+	data = record.AppendSensor(data, 3, 0, record.Sensor{Timestamp: 300, ODR: 2500, Samples: []byte{3, 0}})
+
+	kept := withoutSensorRecords(data, []uint32{1, 3})
+
+	if !bytes.Equal(kept, data[damaged:damaged+len(kept)]) || len(kept) != damaged {
+		t.Fatalf("kept % x, want the damaged record % x", kept, data[damaged:2*damaged])
+	}
+	if records, errs := decode.All(kept); len(records) != 0 || len(errs) != 1 {
+		t.Fatalf("%d records and %d damaged spans left, want the damaged span only", len(records), len(errs))
+	}
+}
+
+func TestDeletingNeedsConfirmedDigest(t *testing.T) {
+	savedData, savedSynced, savedVerified, savedClearBit, savedFlash := serializedSensorData, sensorDataSynced, sensorDataDigestVerified, sensorDataClearBit, sensorFlashPath
+	savedRecords, savedDelivered := sensorDataTransferRecords, sensorDataTransferDelivered
+	defer func() {
+		serializedSensorData, sensorDataSynced, sensorDataDigestVerified, sensorDataClearBit, sensorFlashPath = savedData, savedSynced, savedVerified, savedClearBit, savedFlash
+		sensorDataTransferRecords, sensorDataTransferDelivered = savedRecords, savedDelivered
+	}()
+	sensorFlashPath = filepath.Join(t.TempDir(), "flash.bin")
+
+	// Both records delivered by the current transfer
+	var data []byte
+	sensorDataTransferRecords = nil
+	for id := uint32(1); id <= 2; id++ {
+		data = record.AppendSensor(data, id, 0, record.Sensor{Timestamp: int64(id), ODR: 2500, Samples: []byte{byte(id), 0}})
+		sensorDataTransferRecords = append(sensorDataTransferRecords, sensorDataTransferRecord{id: id, end: len(data)})
+	}
+	sensorDataTransferDelivered = len(data)
+
+	tests := []struct {
+		name     string
+		op       byte
+		clearBit byte
+		verified bool
+		rejected []uint32
+		left     int // Records left in memory
+	}{
+		{"delete unverified", sensorDataDeleteRecords, 0, false, []uint32{1, 2}, 2},
+		{"delete verified", sensorDataDeleteRecords, 0, true, nil, 0},
+		{"acknowledge and clear unverified", sensorDataAckRecords, 1, false, nil, 2},
+		{"acknowledge and clear verified", sensorDataAckRecords, 1, true, nil, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serializedSensorData = bytes.Clone(data)
+			sensorDataSynced = nil
+			if test.op == sensorDataDeleteRecords {
+				sensorDataSynced = []uint32{1, 2}
+			}
+			sensorDataDigestVerified = test.verified
+			sensorDataClearBit = test.clearBit
+
+			if rejected := applySensorDataAck(test.op, []uint32{1, 2}); !slices.Equal(rejected, test.rejected) {
+				t.Errorf("rejected %v, want %v", rejected, test.rejected)
+			}
+			if records, _ := decode.All(serializedSensorData); len(records) != test.left {
+				t.Errorf("%d records left, want %d", len(records), test.left)
+			}
+		})
+	}
+}
+
+func TestRefusedConfirmKeepsTransferState(t *testing.T) {
+	savedRecords, savedVerified, savedInTransfer, savedStream := sensorDataTransferRecords, sensorDataDigestVerified, sensorDataInTransfer, sensorDataStream
+	defer func() {
+		sensorDataTransferRecords, sensorDataDigestVerified, sensorDataInTransfer, sensorDataStream = savedRecords, savedVerified, savedInTransfer, savedStream
+	}()
+
+	sensorDataTransferRecords = []sensorDataTransferRecord{{id: 1, end: 28}}
+	sensorDataDigestVerified = false
+	sensorDataInTransfer = false
+	sensorDataStream = sensorDataStreamStruct{}
+
+	confirmSensorDataRead(0, []byte{0x01})
+	if sensorDataInTransfer {
+		t.Fatal("a confirm refused for the digest started staging new sensor data")
+	}
+}
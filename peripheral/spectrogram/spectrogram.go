@@ -0,0 +1,311 @@
+// Package spectrogram renders stored sensor events as PNG images: a short
+// time Fourier transform spectrogram above a waveform strip. Only the standard
+// library image packages are used.
+//
+// A single record holds only a few samples, too few for an STFT. Join
+// concatenates consecutive records into segments long enough to render.
+package spectrogram
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"math/cmplx"
+	"slices"
+
+	"go-ble/record"
+)
+
+// Options controls the rendered image. Zero values select the defaults.
+type Options struct {
+	Width          int // Image width in pixels, default 512
+	SpectrumHeight int // Height of the spectrogram in pixels, default 256
+	WaveformHeight int // Height of the waveform strip in pixels, default 96
+	Window         int // STFT window in samples, rounded down to a power of two, default 256
+	Hop            int // STFT hop in samples, default Window/4
+	DynamicRange   float64
+}
+
+const separatorHeight = 4
+
+// MinSamples is the shortest signal Render accepts, a single STFT frame of 64
+// samples. Shorter windows resolve too few frequency bins to be useful.
+const MinSamples = 64
+
+var ErrTooShort = errors.New("spectrogram: fewer samples than MinSamples")
+
+// Segment is a run of consecutive records sharing an ODR, joined into a single
+// signal. The gaps between the records are dropped, so the time axis of the
+// spectrogram is sample time: Sensor starts at the first record and its
+// TimeLength is the sum of the record lengths.
+type Segment struct {
+	First  uint32   // ID of the first record
+	Last   uint32   // ID of the last record
+	IDs    []uint32 // IDs of every joined record
+	Sensor record.Sensor
+}
+
+// Contains reports whether the record with the ID was joined into the segment.
+func (s Segment) Contains(id uint32) bool {
+	return slices.Contains(s.IDs, id)
+}
+
+// Name is the file name of the segment's image without extension,
+// record_<first>-<last>.
+func (s Segment) Name() string {
+	return fmt.Sprintf("record_%d-%d", s.First, s.Last)
+}
+
+// Join concatenates the samples of consecutive events with the same ODR, ids
+// holds the record ID of every event.
+func Join(ids []uint32, events []record.Sensor) []Segment {
+	var segments []Segment
+	for i, s := range events {
+		if n := len(segments); n > 0 && segments[n-1].Sensor.ODR == s.ODR {
+			last := &segments[n-1]
+			last.Last = ids[i]
+			last.IDs = append(last.IDs, ids[i])
+			last.Sensor.TimeLength += s.TimeLength
+			last.Sensor.Samples = append(last.Sensor.Samples, s.Samples...)
+			continue
+		}
+		s.Samples = append([]byte(nil), s.Samples...)
+		segments = append(segments, Segment{First: ids[i], Last: ids[i], IDs: []uint32{ids[i]}, Sensor: s})
+	}
+	return segments
+}
+
+var (
+	background = color.RGBA{0x10, 0x10, 0x14, 0xff}
+	waveColor  = color.RGBA{0x4c, 0xc9, 0xf0, 0xff}
+	axisColor  = color.RGBA{0x40, 0x40, 0x48, 0xff}
+	separator  = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+func (o Options) withDefaults() Options {
+	if o.Width <= 0 {
+		o.Width = 512
+	}
+	if o.SpectrumHeight <= 0 {
+		o.SpectrumHeight = 256
+	}
+	if o.WaveformHeight <= 0 {
+		o.WaveformHeight = 96
+	}
+	if o.Window <= 0 {
+		o.Window = 256
+	}
+	if o.DynamicRange <= 0 {
+		o.DynamicRange = 80 // dB
+	}
+	return o
+}
+
+// Render draws the spectrogram and waveform of a single event or segment. It
+// fails with ErrTooShort for fewer than MinSamples samples.
+func Render(s record.Sensor, opts Options) (*image.RGBA, error) {
+	if len(s.Values()) < MinSamples {
+		return nil, ErrTooShort
+	}
+	opts = opts.withDefaults()
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.SpectrumHeight+opts.WaveformHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+	samples := centered(s.Values())
+	drawSpectrum(img, image.Rect(0, 0, opts.Width, opts.SpectrumHeight), samples, opts)
+	drawWaveform(img, image.Rect(0, opts.SpectrumHeight, opts.Width, img.Bounds().Dy()), samples)
+	return img, nil
+}
+
+// RenderBatch stacks the renderings of several events vertically, separated
+// by a thin white line. It fails if any of them is too short to render.
+func RenderBatch(events []record.Sensor, opts Options) (*image.RGBA, error) {
+	opts = opts.withDefaults()
+	height := opts.SpectrumHeight + opts.WaveformHeight
+	total := len(events)*height + max(len(events)-1, 0)*separatorHeight
+
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, max(total, 1)))
+	draw.Draw(img, img.Bounds(), image.NewUniform(separator), image.Point{}, draw.Src)
+
+	for i, s := range events {
+		top := i * (height + separatorHeight)
+		tile, err := Render(s, opts)
+		if err != nil {
+			return nil, err
+		}
+		draw.Draw(img, image.Rect(0, top, opts.Width, top+height), tile, image.Point{}, draw.Src)
+	}
+	return img, nil
+}
+
+// WritePNG encodes img as PNG.
+func WritePNG(w io.Writer, img image.Image) error {
+	return png.Encode(w, img)
+}
+
+// Removes the DC offset of the unsigned sensor samples.
+func centered(values []uint16) []float64 {
+	samples := make([]float64, len(values))
+	mean := 0.0
+	for _, v := range values {
+		mean += float64(v)
+	}
+	if len(values) > 0 {
+		mean /= float64(len(values))
+	}
+	for i, v := range values {
+		samples[i] = float64(v) - mean
+	}
+	return samples
+}
+
+func drawSpectrum(img *image.RGBA, r image.Rectangle, samples []float64, opts Options) {
+	window := 1
+	for window*2 <= min(opts.Window, len(samples)) {
+		window *= 2
+	}
+	if window < 2 {
+		return
+	}
+	hop := opts.Hop
+	if hop <= 0 || hop > window {
+		hop = max(window/4, 1)
+	}
+
+	frames := stft(samples, window, hop)
+	bins := window/2 + 1
+
+	peak := math.Inf(-1)
+	for _, frame := range frames {
+		for _, power := range frame {
+			peak = max(peak, power)
+		}
+	}
+
+	for x := 0; x < r.Dx(); x++ {
+		frame := frames[x*len(frames)/r.Dx()]
+		for y := 0; y < r.Dy(); y++ {
+			// Low frequencies at the bottom.
+			bin := (r.Dy() - 1 - y) * bins / r.Dy()
+			level := 1 - (peak-frame[bin])/opts.DynamicRange
+			img.SetRGBA(r.Min.X+x, r.Min.Y+y, heat(level))
+		}
+	}
+}
+
+// Returns the power of every frame in dB, one slice of window/2+1 bins per frame.
+func stft(samples []float64, window, hop int) [][]float64 {
+	hann := make([]float64, window)
+	for i := range hann {
+		hann[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(window-1))
+	}
+
+	var frames [][]float64
+	buffer := make([]complex128, window)
+	for start := 0; start+window <= len(samples); start += hop {
+		for i := range buffer {
+			buffer[i] = complex(samples[start+i]*hann[i], 0)
+		}
+		fft(buffer)
+
+		frame := make([]float64, window/2+1)
+		for i := range frame {
+			frame[i] = 10 * math.Log10(math.Pow(cmplx.Abs(buffer[i]), 2)+1e-12)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// In-place radix-2 FFT, len(a) must be a power of two.
+func fft(a []complex128) {
+	n := len(a)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := a[start+k], a[start+k+size/2]*w
+				a[start+k] = even + odd
+				a[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
+
+func drawWaveform(img *image.RGBA, r image.Rectangle, samples []float64) {
+	middle := r.Min.Y + r.Dy()/2
+	for x := r.Min.X; x < r.Max.X; x++ {
+		img.SetRGBA(x, middle, axisColor)
+	}
+	if len(samples) == 0 {
+		return
+	}
+
+	peak := 0.0
+	for _, s := range samples {
+		peak = max(peak, math.Abs(s))
+	}
+	if peak == 0 {
+		peak = 1
+	}
+	scale := float64(r.Dy()/2-2) / peak
+
+	previous := middle - int(samples[0]*scale)
+	for x := 0; x < r.Dx(); x++ {
+		// Every column spans a range of samples, draw its min to max.
+		from := x * len(samples) / r.Dx()
+		to := max((x+1)*len(samples)/r.Dx(), from+1)
+
+		low, high := previous, previous
+		for _, s := range samples[from:to] {
+			y := middle - int(s*scale)
+			low, high = min(low, y), max(high, y)
+		}
+		for y := low; y <= high; y++ {
+			img.SetRGBA(r.Min.X+x, y, waveColor)
+		}
+		previous = middle - int(samples[to-1]*scale)
+	}
+}
+
+// Maps a level in [0, 1] onto a black, purple, orange, yellow gradient.
+func heat(level float64) color.RGBA {
+	level = min(max(level, 0), 1)
+	stops := []color.RGBA{
+		{0x00, 0x00, 0x04, 0xff},
+		{0x57, 0x10, 0x6e, 0xff},
+		{0xbc, 0x37, 0x54, 0xff},
+		{0xf9, 0x8e, 0x09, 0xff},
+		{0xfc, 0xff, 0xa4, 0xff},
+	}
+	position := level * float64(len(stops)-1)
+	i := min(int(position), len(stops)-2)
+	t := position - float64(i)
+
+	lerp := func(a, b uint8) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*t)
+	}
+	return color.RGBA{
+		lerp(stops[i].R, stops[i+1].R),
+		lerp(stops[i].G, stops[i+1].G),
+		lerp(stops[i].B, stops[i+1].B),
+		0xff,
+	}
+}
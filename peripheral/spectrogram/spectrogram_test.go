@@ -0,0 +1,127 @@
+package spectrogram
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+
+	"go-ble/record"
+)
+
+const (
+	testODR    = 2500
+	testWindow = 256
+	testBin    = 32 // 312.5 Hz at 2500 Hz and a 256 sample window
+)
+
+// Samples of a sine centred on the middle of the 10 bit sensor range.
+func sine(n int, frequency float64) []byte {
+	samples := make([]byte, 0, n*record.SampleWidth)
+	for i := range n {
+		v := 512 + 400*math.Sin(2*math.Pi*frequency*float64(i)/testODR)
+		samples = binary.LittleEndian.AppendUint16(samples, uint16(math.Round(v)))
+	}
+	return samples
+}
+
+func peakBin(frame []float64) int {
+	peak := 0
+	for i, power := range frame {
+		if power > frame[peak] {
+			peak = i
+		}
+	}
+	return peak
+}
+
+func TestSTFTSine(t *testing.T) {
+	frequency := float64(testODR) * testBin / testWindow
+	s := record.Sensor{ODR: testODR, Samples: sine(1024, frequency)}
+
+	frames := stft(centered(s.Values()), testWindow, testWindow/4)
+	if len(frames) != (1024-testWindow)/(testWindow/4)+1 {
+		t.Fatalf("%d frames", len(frames))
+	}
+	for i, frame := range frames {
+		if bin := peakBin(frame); bin != testBin {
+			t.Fatalf("frame %d peaks at bin %d, want %d", i, bin, testBin)
+		}
+	}
+}
+
+func TestJoinShortRecords(t *testing.T) {
+	frequency := float64(testODR) * testBin / testWindow
+	signal := sine(1024, frequency)
+
+	// Records of 3 to 10 samples, like the sensor produces
+	var ids []uint32
+	var events []record.Sensor
+	for offset, n := 0, 3; offset < len(signal); n = n%10 + 3 {
+		end := min(offset+n*record.SampleWidth, len(signal))
+		ids = append(ids, uint32(len(ids)+1))
+		events = append(events, record.Sensor{Timestamp: int64(offset), TimeLength: 400, ODR: testODR, Samples: signal[offset:end]})
+		offset = end
+	}
+	for _, s := range events {
+		if _, err := Render(s, Options{}); !errors.Is(err, ErrTooShort) {
+			t.Fatalf("rendering %d samples: %v, want ErrTooShort", len(s.Values()), err)
+		}
+	}
+
+	segments := Join(ids, events)
+	if len(segments) != 1 {
+		t.Fatalf("%d segments, want 1", len(segments))
+	}
+	segment := segments[0]
+	if segment.First != 1 || segment.Last != ids[len(ids)-1] || segment.Sensor.TimeLength != uint32(400*len(events)) {
+		t.Fatalf("segment %d-%d of %d us", segment.First, segment.Last, segment.Sensor.TimeLength)
+	}
+
+	frames := stft(centered(segment.Sensor.Values()), testWindow, testWindow/4)
+	for i, frame := range frames {
+		if bin := peakBin(frame); bin != testBin {
+			t.Fatalf("frame %d peaks at bin %d, want %d", i, bin, testBin)
+		}
+	}
+	if _, err := Render(segment.Sensor, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Joining must not write into the samples of the records
+	if events[0].Samples[0] != signal[0] || len(events[0].Samples) != 3*record.SampleWidth {
+		t.Fatal("Join modified the first record")
+	}
+}
+
+func TestJoinSplitsOnODR(t *testing.T) {
+	events := []record.Sensor{
+		{ODR: 2500, Samples: []byte{1, 0}},
+		{ODR: 2500, Samples: []byte{2, 0}},
+		{ODR: 1000, Samples: []byte{3, 0}},
+		{ODR: 2500, Samples: []byte{4, 0}},
+	}
+	segments := Join([]uint32{10, 11, 12, 13}, events)
+
+	want := [][2]uint32{{10, 11}, {12, 12}, {13, 13}}
+	if len(segments) != len(want) {
+		t.Fatalf("%d segments, want %d", len(segments), len(want))
+	}
+	for i, segment := range segments {
+		if segment.First != want[i][0] || segment.Last != want[i][1] {
+			t.Errorf("segment %d spans %d-%d, want %d-%d", i, segment.First, segment.Last, want[i][0], want[i][1])
+		}
+	}
+	if got := segments[0].Sensor.Values(); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("first segment samples %v", got)
+	}
+
+	if !segments[0].Contains(11) || segments[0].Contains(12) || !segments[2].Contains(13) {
+		t.Errorf("segment IDs %v, %v, %v", segments[0].IDs, segments[1].IDs, segments[2].IDs)
+	}
+	for i, name := range []string{"record_10-11", "record_12-12", "record_13-13"} {
+		if got := segments[i].Name(); got != name {
+			t.Errorf("segment %d named %q, want %q", i, got, name)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Sensor data stream control opcodes, the first byte written to sensorDataStreamControlHandle.
+const (
+	sensorDataStreamStart      byte = 0x01 // Start streaming the selected records
+	sensorDataStreamCredit     byte = 0x02 // Followed by uint16 credits, one notification each
+	sensorDataStreamRetransmit byte = 0x03 // Followed by one or more uint16 sequence numbers to resend
+	sensorDataStreamComplete   byte = 0x04 // Followed by uint16 count of packets received in sequence
+	sensorDataStreamAbort      byte = 0x05
+)
+
+// Every stream notification starts with a uint16 sequence number and a flags byte.
+const (
+	sensorDataStreamHeader   = 3
+	sensorDataStreamLastFlag = 0x01
+
+	// Sequence numbers and the status packet count are uint16
+	sensorDataStreamMaxPackets = 0xffff
+)
+
+// State of the credit based sensor data stream. Packet seq carries the bytes
+// [seq*payload, (seq+1)*payload) of sensorDataTransfer.
+type sensorDataStreamStruct struct {
+	active     bool
+	payload    int
+	packets    int
+	next       int
+	credits    int
+	retransmit []uint16
+
+	started        time.Time
+	sent           int // Packets sent for the first time
+	retransmitted  int
+	bytesSent      int // Payload bytes sent for the first time, the throughput counts these only
+	lastThroughput uint32
+}
+
+func (stream *sensorDataStreamStruct) packet(seq int) []byte {
+	start := seq * stream.payload
+	end := min(start+stream.payload, len(sensorDataTransfer))
+
+	var flags byte
+	if end == len(sensorDataTransfer) {
+		flags |= sensorDataStreamLastFlag
+	}
+
+	packet := binary.LittleEndian.AppendUint16(nil, uint16(seq))
+	packet = append(packet, flags)
+	return append(packet, sensorDataTransfer[start:end]...)
+}
+
+// Send as many packets as there are credits, retransmissions first.
+// Caller must hold serializedSensorDataMutex.
+func (stream *sensorDataStreamStruct) pump() {
+	for stream.active && stream.credits > 0 {
+		var seq int
+		retransmission := len(stream.retransmit) > 0
+		switch {
+		case retransmission:
+			seq = int(stream.retransmit[0])
+			stream.retransmit = stream.retransmit[1:]
+		case stream.next < stream.packets:
+			seq = stream.next
+			stream.next++
+		default:
+			return
+		}
+
+		packet := stream.packet(seq)
+		sensorDataStreamHandle.Write(packet)
+		stream.credits--
+		if retransmission {
+			stream.retransmitted++
+		} else {
+			stream.sent++
+			stream.bytesSent += len(packet) - sensorDataStreamHeader
+		}
+	}
+}
+
+// Handle a write to the stream control characteristic. Caller must hold serializedSensorDataMutex.
+func (stream *sensorDataStreamStruct) control(value []byte) bool {
+	if len(value) == 0 {
+		return false
+	}
+
+	op, args := value[0], value[1:]
+	switch op {
+	case sensorDataStreamStart:
+		if len(args) != 0 {
+			return false
+		}
+		payload := sensorDataChunkSize() - sensorDataStreamHeader
+		packets := (len(sensorDataTransfer) + payload - 1) / payload
+		if packets > sensorDataStreamMaxPackets {
+			println("Stream of", packets, "packets exceeds the sequence numbers, select fewer records.")
+			return false
+		}
+		*stream = sensorDataStreamStruct{
+			active:  true,
+			payload: payload,
+			packets: packets,
+			started: time.Now(),
+		}
+		// Chunks published on sensorDataHandle are no longer part of the transfer,
+		// and new sensor data is staged until it ends.
+		serializedSensorDataRange = []int{0, 0}
+		sensorDataInTransfer = true
+		sensorDataTransferActivity = time.Now()
+		println("Streaming", len(sensorDataTransfer), "bytes in", stream.packets, "packets of", payload, "bytes.")
+	case sensorDataStreamCredit:
+		if len(args) != 2 || !stream.active {
+			return false
+		}
+		stream.credits += int(binary.LittleEndian.Uint16(args))
+		stream.pump()
+	case sensorDataStreamRetransmit:
+		if len(args) == 0 || len(args)%2 != 0 || !stream.active {
+			return false
+		}
+		// Only packets already sent can be resent, the request is all or nothing
+		var seqs []uint16
+		for i := 0; i < len(args); i += 2 {
+			seq := binary.LittleEndian.Uint16(args[i:])
+			if int(seq) >= stream.next {
+				return false
+			}
+			seqs = append(seqs, seq)
+		}
+		stream.retransmit = append(stream.retransmit, seqs...)
+		stream.pump()
+	case sensorDataStreamComplete:
+		if len(args) != 2 || !stream.active {
+			return false
+		}
+		received := min(int(binary.LittleEndian.Uint16(args)), stream.next)
+		stream.finish(min(received*stream.payload, len(sensorDataTransfer)))
+	case sensorDataStreamAbort:
+		if !stream.active {
+			return false
+		}
+		stream.finish(0)
+	default:
+		return false
+	}
+
+	sensorDataTransferActivity = time.Now()
+	sensorDataStreamControlHandle.Write(stream.status())
+	return true
+}
+
+// End the stream, the central received the first delivered bytes of the transfer.
+func (stream *sensorDataStreamStruct) finish(delivered int) {
+	stream.active = false
+
+	sensorDataTransferDelivered += delivered
+	sensorDataTransfer = sensorDataTransfer[delivered:]
+
+	elapsed := time.Since(stream.started)
+	if elapsed > 0 {
+		stream.lastThroughput = uint32(float64(stream.bytesSent) / elapsed.Seconds())
+	}
+
+	sensorDataStreamStatsHandle.Write(stream.stats(elapsed))
+
+	println("Stream finished:", delivered, "bytes delivered,", stream.sent, "packets,", stream.retransmitted, "retransmitted,",
+		elapsed.Milliseconds(), "ms,", stream.lastThroughput, "B/s")
+}
+
+// Stats: uint32 bytes, packets, retransmissions, duration in ms and throughput
+// in B/s. Retransmissions aren't bounded by the sequence numbers, a long stream
+// with a bad link can resend more than 0xFFFF packets.
+func (stream *sensorDataStreamStruct) stats(elapsed time.Duration) []byte {
+	stats := binary.LittleEndian.AppendUint32(nil, uint32(stream.bytesSent))
+	stats = binary.LittleEndian.AppendUint32(stats, uint32(stream.sent))
+	stats = binary.LittleEndian.AppendUint32(stats, uint32(stream.retransmitted))
+	stats = binary.LittleEndian.AppendUint32(stats, uint32(elapsed.Milliseconds()))
+	return binary.LittleEndian.AppendUint32(stats, stream.lastThroughput)
+}
+
+// Status: active flag, uint16 packet count, uint16 payload size, uint16 next sequence, uint16 credits left.
+func (stream *sensorDataStreamStruct) status() []byte {
+	status := []byte{0x00}
+	if stream.active {
+		status[0] = 0x01
+	}
+	status = binary.LittleEndian.AppendUint16(status, uint16(stream.packets))
+	status = binary.LittleEndian.AppendUint16(status, uint16(stream.payload))
+	status = binary.LittleEndian.AppendUint16(status, uint16(stream.next))
+	return binary.LittleEndian.AppendUint16(status, uint16(stream.credits))
+}
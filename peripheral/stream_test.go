@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestStreamStartBoundsPackets(t *testing.T) {
+	savedTransfer, savedMTU := sensorDataTransfer, connectionMTU
+	defer func() { sensorDataTransfer, connectionMTU = savedTransfer, savedMTU }()
+
+	connectionMTU = defaultATTMTU
+	payload := sensorDataChunkSize() - sensorDataStreamHeader
+	sensorDataTransfer = make([]byte, (sensorDataStreamMaxPackets+1)*payload)
+
+	var stream sensorDataStreamStruct
+	if stream.control([]byte{sensorDataStreamStart}) {
+		t.Fatal("started a stream of more packets than sequence numbers")
+	}
+	if stream.active {
+		t.Fatal("stream active after a refused start")
+	}
+}
+
+func TestStreamRetransmitAllOrNothing(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{"unsent sequence last", []byte{sensorDataStreamRetransmit, 0, 0, 1, 0, 4, 0}},
+		{"unsent sequence first", []byte{sensorDataStreamRetransmit, 9, 0, 0, 0}},
+		{"odd length", []byte{sensorDataStreamRetransmit, 0, 0, 1}},
+		{"no sequence", []byte{sensorDataStreamRetransmit}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := sensorDataStreamStruct{active: true, payload: 17, packets: 8, next: 4}
+			if stream.control(tt.value) {
+				t.Fatal("retransmit accepted")
+			}
+			if len(stream.retransmit) != 0 {
+				t.Fatalf("queued %v of a refused retransmit", stream.retransmit)
+			}
+		})
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	stream := sensorDataStreamStruct{bytesSent: 1 << 20, sent: 65535, retransmitted: 70000, lastThroughput: 4096}
+	stats := stream.stats(1500 * time.Millisecond)
+
+	want := []uint32{1 << 20, 65535, 70000, 1500, 4096}
+	if len(stats) != 4*len(want) {
+		t.Fatalf("stats of %d bytes, want %d", len(stats), 4*len(want))
+	}
+	for i, w := range want {
+		if got := binary.LittleEndian.Uint32(stats[4*i:]); got != w {
+			t.Errorf("field %d: %d, want %d", i, got, w)
+		}
+	}
+}
+
+func TestConfirmRefusedWhileStreaming(t *testing.T) {
+	savedTransfer, savedRange, savedStream, savedInTransfer := sensorDataTransfer, serializedSensorDataRange, sensorDataStream, sensorDataInTransfer
+	defer func() {
+		sensorDataTransfer, serializedSensorDataRange, sensorDataStream, sensorDataInTransfer = savedTransfer, savedRange, savedStream, savedInTransfer
+	}()
+
+	transfer := []byte{1, 2, 3, 4, 5, 6}
+	for _, value := range []byte{0x00, 0x01} {
+		sensorDataTransfer = bytes.Clone(transfer)
+		serializedSensorDataRange = []int{0, 4}
+		sensorDataStream = sensorDataStreamStruct{active: true, payload: 4, packets: 2}
+		sensorDataInTransfer = false
+
+		confirmSensorDataRead(0, []byte{value})
+		if !bytes.Equal(sensorDataTransfer, transfer) || serializedSensorDataRange[1] != 4 || sensorDataInTransfer || !sensorDataStream.active {
+			t.Errorf("confirm 0x%02X changed the transfer of an active stream", value)
+		}
+	}
+}
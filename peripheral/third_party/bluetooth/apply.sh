@@ -0,0 +1,23 @@
+#!/bin/sh
+# Recreate module/: tinygo.org/x/bluetooth at the pinned version with
+# bluetooth.patch applied. Run it after a checkout and after changing the
+# patch, the peripheral builds against module/ through the replace directive
+# in peripheral/go.mod.
+set -eu
+
+version=v0.11.0
+
+cd "$(dirname "$0")"
+
+dir=$(go mod download -json "tinygo.org/x/bluetooth@$version" | sed -n 's/^[[:space:]]*"Dir": "\(.*\)",$/\1/p')
+if [ -z "$dir" ]; then
+	echo "apply.sh: downloading tinygo.org/x/bluetooth@$version failed" >&2
+	exit 1
+fi
+
+rm -rf module
+cp -R "$dir" module
+chmod -R u+w module
+patch -s -p1 -d module <bluetooth.patch
+
+echo "tinygo.org/x/bluetooth@$version patched in $(pwd)/module"
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Config transaction: a batch of register writes applied all-or-nothing, so a
+// disconnect can't leave the device half configured.
+//
+// Request, TLV encoded: per item the uint8 register tag, the uint8 value length
+// and the value, encoded as for the register characteristic.
+// Result, read/notify on the same characteristic: uint8 ATT code of the
+// transaction, uint32 config generation after it, then per item the uint8 tag
+// and the uint8 ATT code of the item. Unless the transaction code is 0x00 no
+// register changed, items reporting 0x00 included.
+//
+// A transaction must fit one write request, ATT MTU - 3 bytes: 20 bytes at the
+// default MTU of 23, while all eight registers take 28. Long writes arrive as
+// parts: the first one is rejected as truncated (0x0D), the following ones
+// with Invalid Offset (0x07). Centrals either negotiate a larger MTU or split
+// the registers across transactions.
+
+// Register tags
+const (
+	configTagSensorODR          byte = 0x01
+	configTagTransmitPower      byte = 0x02
+	configTagAdvIntervalGlobal  byte = 0x03
+	configTagAdvDuration        byte = 0x04
+	configTagAdvIntervalLocal   byte = 0x05
+	configTagResponseTimeout    byte = 0x06
+	configTagAutoDisconnectBit  byte = 0x07
+	configTagSensorDataClearBit byte = 0x08
+)
+
+// A register a transaction can write. value returns the register in config,
+// stage decodes and checks a value and sets it in config, returning
+// attSuccess or the ATT error code.
+type configRegisterStruct struct {
+	name  string
+	uuid  *bluetooth.UUID
+	value func(config nvmConfigStruct) any
+	stage func(config *nvmConfigStruct, value []byte) byte
+}
+
+var configRegisters = map[byte]configRegisterStruct{
+	configTagSensorODR: {
+		name:  "sensor ODR",
+		uuid:  &sensorODRCharacteristicUUID,
+		value: func(config nvmConfigStruct) any { return config.SensorODR },
+		stage: func(config *nvmConfigStruct, value []byte) byte {
+			return stageRegister(sensorODRCharacteristicUUID, value, &config.SensorODR)
+		},
+	},
+	configTagTransmitPower: {
+		name:  "transmit power",
+		uuid:  &transmitPowerCharacteristicUUID,
+		value: func(config nvmConfigStruct) any { return config.TransmitPower },
+		stage: func(config *nvmConfigStruct, value []byte) byte {
+			return stageRegister(transmitPowerCharacteristicUUID, value, &config.TransmitPower)
+		},
+	},
+	configTagAdvIntervalGlobal: {
+		name:  "advertising interval (global)",
+		uuid:  &advIntervalGlobalCharacteristicUUID,
+		value: func(config nvmConfigStruct) any { return config.AdvIntervalGlobal },
+		stage: func(config *nvmConfigStruct, value []byte) byte {
+			return stageRegister(advIntervalGlobalCharacteristicUUID, value, &config.AdvIntervalGlobal)
+		},
+	},
+	configTagAdvDuration: {
+		name:  "advertising duration",
+		uuid:  &advDurationCharacteristicUUID,
+		value: func(config nvmConfigStruct) any { return config.AdvDuration },
+		stage: func(config *nvmConfigStruct, value []byte) byte {
+			return stageRegister(advDurationCharacteristicUUID, value, &config.AdvDuration)
+		},
+	},
+	configTagAdvIntervalLocal: {
+		name:  "advertising interval (local)",
+		uuid:  &advIntervalLocalCharacteristicUUID,
+		value: func(config nvmConfigStruct) any { return config.AdvIntervalLocal },
+		stage: func(config *nvmConfigStruct, value []byte) byte {
+			return stageRegister(advIntervalLocalCharacteristicUUID, value, &config.AdvIntervalLocal)
+		},
+	},
+	configTagResponseTimeout: {
+		name:  "response timeout",
+		uuid:  &responseTimeoutCharacteristicUUID,
+		value: func(config nvmConfigStruct) any { return config.ResponseTimeout },
+		stage: func(config *nvmConfigStruct, value []byte) byte {
+			return stageRegister(responseTimeoutCharacteristicUUID, value, &config.ResponseTimeout)
+		},
+	},
+	configTagAutoDisconnectBit: {
+		name:  "auto disconnect bit",
+		uuid:  &autoDisconnectBitCharacteristicUUID,
+		value: func(config nvmConfigStruct) any { return config.AutoDisconnectBit },
+		stage: func(config *nvmConfigStruct, value []byte) byte {
+			return stageRegister(autoDisconnectBitCharacteristicUUID, value, &config.AutoDisconnectBit)
+		},
+	},
+	configTagSensorDataClearBit: {
+		name:  "sensor data clear bit",
+		uuid:  &sensorDataClearBitCharacteristicUUID,
+		value: func(config nvmConfigStruct) any { return config.SensorDataClearBit },
+		stage: func(config *nvmConfigStruct, value []byte) byte {
+			return stageRegister(sensorDataClearBitCharacteristicUUID, value, &config.SensorDataClearBit)
+		},
+	},
+}
+
+// The register a characteristic UUID belongs to.
+func configRegisterByUUID(id bluetooth.UUID) (configRegisterStruct, bool) {
+	for _, register := range configRegisters {
+		if *register.uuid == id {
+			return register, true
+		}
+	}
+	return configRegisterStruct{}, false
+}
+
+func stageRegister[T registerType](id bluetooth.UUID, value []byte, field *T) byte {
+	n, code := checkRegisterWrite[T](id, value)
+	if code == attSuccess {
+		*field = n
+	}
+	return code
+}
+
+type configTransactionItem struct {
+	tag   byte
+	value []byte
+}
+
+// Split a transaction into its items. ok is false if the TLV encoding is
+// truncated or the transaction is empty.
+func parseConfigTransaction(data []byte) (items []configTransactionItem, ok bool) {
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, false
+		}
+		items = append(items, configTransactionItem{tag: data[0], value: data[2 : 2+int(data[1])]})
+		data = data[2+int(data[1]):]
+	}
+	return items, len(items) > 0
+}
+
+// A staged transaction: the configuration with every accepted item set, the
+// ATT code of each item and of the transaction, the code of its first
+// rejected item. A truncated or empty request has no items and reports
+// attErrorInvalidLength.
+type configTransactionStruct struct {
+	staged nvmConfigStruct
+	items  []configTransactionItem
+	codes  []byte
+	status byte
+}
+
+// Stage every item of a transaction on a copy of config.
+func stageConfigTransaction(data []byte, config nvmConfigStruct) configTransactionStruct {
+	items, ok := parseConfigTransaction(data)
+	if !ok {
+		return configTransactionStruct{staged: config, status: attErrorInvalidLength}
+	}
+
+	transaction := configTransactionStruct{staged: config, items: items, codes: make([]byte, len(items)), status: attSuccess}
+	seen := map[byte]bool{}
+	for i, item := range items {
+		register, known := configRegisters[item.tag]
+		switch {
+		case !known:
+			transaction.codes[i] = attErrorNotFound
+		case seen[item.tag]:
+			transaction.codes[i] = attErrorValueNotAllowed
+		default:
+			transaction.codes[i] = register.stage(&transaction.staged, item.value)
+		}
+		seen[item.tag] = true
+
+		if transaction.codes[i] != attSuccess && transaction.status == attSuccess {
+			transaction.status = transaction.codes[i]
+		}
+	}
+	return transaction
+}
+
+// The ValidateWrite of the config transaction characteristic: a rejected
+// transaction is answered with its ATT error, audited and its result
+// published. Accepted ones are run by the write event.
+func validateConfigTransaction(client bluetooth.Connection, offset int, data []byte) error {
+	if offset != 0 {
+		println("Rejected config transaction part at offset", offset, "- long writes aren't supported, a transaction must fit one write of ATT MTU - 3 bytes")
+		publishConfigTransactionResult(configTransactionStruct{status: attErrorInvalidOffset})
+		return bluetooth.ATTError(attErrorInvalidOffset)
+	}
+
+	transaction := stageConfigTransaction(data, currentConfig())
+	if transaction.status == attSuccess {
+		return nil
+	}
+	rejectConfigTransaction(client, data, transaction)
+	return bluetooth.ATTError(transaction.status)
+}
+
+// Run a transaction: stage every item on a copy of the configuration and apply
+// the copy only if all of them are accepted.
+func runConfigTransaction(client bluetooth.Connection, data []byte) {
+	transaction := stageConfigTransaction(data, currentConfig())
+	if transaction.status != attSuccess {
+		rejectConfigTransaction(client, data, transaction)
+		return
+	}
+
+	auditConfigTransaction(client, transaction)
+	applyConfig(transaction.staged)
+	saveConfig()
+	for _, item := range transaction.items {
+		println("Config transaction set", configRegisters[item.tag].name, "to:", fmt.Sprintf("%x", item.value))
+	}
+	publishConfigTransactionResult(transaction)
+}
+
+func rejectConfigTransaction(client bluetooth.Connection, data []byte, transaction configTransactionStruct) {
+	auditConfigTransaction(client, transaction)
+	println("Rejected config transaction", fmt.Sprintf("%x", data), "error", fmt.Sprintf("0x%02X", transaction.status))
+	publishConfigTransactionResult(transaction)
+}
+
+// Record the items of a transaction in the device log, each with the code of
+// the transaction unless the item itself was rejected: items are applied only
+// together. Items with an unknown tag are recorded by their tag.
+func auditConfigTransaction(client bluetooth.Connection, transaction configTransactionStruct) {
+	for i, item := range transaction.items {
+		code := transaction.codes[i]
+		if code == attSuccess {
+			code = transaction.status
+		}
+		register, known := configRegisters[item.tag]
+		if !known {
+			auditUnknownConfigTag(client, item.tag, item.value, code)
+			continue
+		}
+		auditConfigWrite(client, *register.uuid, item.value, code)
+	}
+}
+
+func publishConfigTransactionResult(transaction configTransactionStruct) {
+	result := []byte{transaction.status}
+	result = binary.LittleEndian.AppendUint32(result, configGeneration)
+	for i, item := range transaction.items {
+		result = append(result, item.tag, transaction.codes[i])
+	}
+	writeConfigRegister(&configTransactionHandle, &selfWritingConfigTransaction, result)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"tinygo.org/x/bluetooth"
+)
+
+func TestParseConfigTransaction(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		items []configTransactionItem
+		ok    bool
+	}{
+		{"one item", []byte{configTagTransmitPower, 1, 0xFD}, []configTransactionItem{{configTagTransmitPower, []byte{0xFD}}}, true},
+		{"two items", []byte{configTagSensorODR, 2, 0xA0, 0x0F, configTagAutoDisconnectBit, 1, 1},
+			[]configTransactionItem{{configTagSensorODR, []byte{0xA0, 0x0F}}, {configTagAutoDisconnectBit, []byte{1}}}, true},
+		{"empty value", []byte{configTagResponseTimeout, 0}, []configTransactionItem{{configTagResponseTimeout, []byte{}}}, true},
+		{"unknown tag parses", []byte{0x7F, 1, 0}, []configTransactionItem{{0x7F, []byte{0}}}, true},
+		{"empty", []byte{}, nil, false},
+		{"missing length", []byte{configTagSensorODR}, nil, false},
+		{"truncated value", []byte{configTagSensorODR, 2, 0xA0}, nil, false},
+		{"truncated second item", []byte{configTagTransmitPower, 1, 0, configTagSensorODR, 2}, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items, ok := parseConfigTransaction(test.data)
+			if ok != test.ok || len(items) != len(test.items) {
+				t.Fatalf("%v, %v, want %v, %v", items, ok, test.items, test.ok)
+			}
+			for i := range items {
+				if items[i].tag != test.items[i].tag || !bytes.Equal(items[i].value, test.items[i].value) {
+					t.Errorf("item %d: %v, want %v", i, items[i], test.items[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRunConfigTransaction(t *testing.T) {
+	savedPath, savedConfig, savedGeneration := nvmPath, currentConfig(), configGeneration
+	defer func() { nvmPath, configGeneration = savedPath, savedGeneration; setConfig(savedConfig) }()
+	nvmPath = filepath.Join(t.TempDir(), "nvm.json")
+	configGeneration = 0 // Published from the fresh NVM by the first change
+
+	initial := savedConfig
+	initial.SensorODR, initial.TransmitPower, initial.AutoDisconnectBit = 2500, 0, 0
+
+	tests := []struct {
+		name   string
+		data   []byte
+		status byte
+		codes  []byte
+		want   func(*nvmConfigStruct) // Registers after the transaction, nil if unchanged
+	}{
+		{"success", []byte{configTagSensorODR, 2, 0xA0, 0x0F, configTagTransmitPower, 1, 0xFD}, attSuccess, []byte{attSuccess, attSuccess},
+			func(c *nvmConfigStruct) { c.SensorODR, c.TransmitPower = 4000, -3 }},
+		{"unknown tag", []byte{configTagSensorODR, 2, 0xA0, 0x0F, 0x7F, 1, 0}, attErrorNotFound, []byte{attSuccess, attErrorNotFound}, nil},
+		{"duplicate tag", []byte{configTagSensorODR, 2, 0xA0, 0x0F, configTagSensorODR, 2, 0xB0, 0x0F}, attErrorValueNotAllowed, []byte{attSuccess, attErrorValueNotAllowed}, nil},
+		{"truncated", []byte{configTagSensorODR, 2, 0xA0}, attErrorInvalidLength, nil, nil},
+		{"partial failure", []byte{configTagSensorODR, 2, 0xA0, 0x0F, configTagAutoDisconnectBit, 1, 2}, attErrorOutOfRange, []byte{attSuccess, attErrorOutOfRange}, nil},
+		{"first rejected item decides", []byte{configTagSensorODR, 1, 0, 0x7F, 0}, attErrorOutOfRange, []byte{attErrorOutOfRange, attErrorNotFound}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setConfig(initial)
+			generation := configGeneration
+
+			transaction := stageConfigTransaction(test.data, currentConfig())
+			if transaction.status != test.status || !bytes.Equal(transaction.codes, test.codes) {
+				t.Fatalf("status 0x%02X, codes %x, want 0x%02X, %x", transaction.status, transaction.codes, test.status, test.codes)
+			}
+
+			runConfigTransaction(0, test.data)
+
+			want := initial
+			wantGeneration := generation
+			if test.want != nil {
+				test.want(&want)
+				wantGeneration++
+			}
+			if got := currentConfig(); got != want {
+				t.Errorf("registers %+v, want %+v", got, want)
+			}
+			if configGeneration != wantGeneration {
+				t.Errorf("config generation %d, want %d", configGeneration, wantGeneration)
+			}
+		})
+	}
+}
+
+func TestValidateConfigTransaction(t *testing.T) {
+	savedPath := nvmPath
+	defer func() { nvmPath = savedPath }()
+	nvmPath = filepath.Join(t.TempDir(), "nvm.json")
+
+	tests := []struct {
+		name   string
+		offset int
+		data   []byte
+		err    error
+	}{
+		{"accepted", 0, []byte{configTagTransmitPower, 1, 0}, nil},
+		{"long write part", 20, []byte{configTagTransmitPower, 1, 0}, bluetooth.ATTError(attErrorInvalidOffset)},
+		{"truncated", 0, []byte{configTagSensorODR, 2}, bluetooth.ATTError(attErrorInvalidLength)},
+		{"unknown tag", 0, []byte{0x7F, 0}, bluetooth.ATTError(attErrorNotFound)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validateConfigTransaction(0, test.offset, test.data); !errors.Is(err, test.err) {
+				t.Errorf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"go-ble/codec"
+	"go-ble/schema"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// ATT error codes of rejected writes
+const (
+	attSuccess              byte = 0x00
+	attErrorInvalidOffset   byte = 0x07 // Invalid Offset: part of a long write
+	attErrorNotFound        byte = 0x0A // Attribute Not Found: unknown register of a config transaction
+	attErrorInvalidLength   byte = 0x0D // Invalid Attribute Value Length
+	attErrorValueNotAllowed byte = 0x80 // Application error: not one of the options, or off the step grid
+	attErrorOutOfRange      byte = 0xFF // Out of Range
+)
+
+// Constraints of a writable characteristic. Schema ranges and options are
+// combined with the peripheral's own limits.
+type writeRuleStruct struct {
+	min     float64
+	max     float64
+	step    float64   // 0 allows every value
+	options []float64 // Nil allows every value within [min, max]
+}
+
+// Limits of the peripheral, on top of the schema
+var peripheralWriteRules = map[*bluetooth.UUID]writeRuleStruct{
+	&sensorODRCharacteristicUUID:           {min: 1, max: math.MaxUint16},
+	&autoDisconnectBitCharacteristicUUID:   {min: 0, max: 1},
+	&sensorDataClearBitCharacteristicUUID:  {min: 0, max: 1},
+	&sensorDataChunkSizeCharacteristicUUID: {min: minTransferChunk, max: maxTransferChunk},
+	&attMTUCharacteristicUUID:              {min: defaultATTMTU, max: math.MaxUint16},
+}
+
+// Integer types of the configuration registers
+type registerType interface {
+	~uint8 | ~uint16 | ~uint32 | ~int8 | ~int16 | ~int32
+}
+
+// Codec of a characteristic value on the wire: the codec of the schema type if
+// the schema describes it, otherwise the codec of fallback, its variable.
+func writeCodec(id bluetooth.UUID, fallback any) codec.Codec {
+	if c, ok := characteristicSchema[id]; ok {
+		return c.DataType.Codec()
+	}
+	native, err := codec.Native(fallback)
+	if err != nil {
+		return codec.Raw
+	}
+	return native
+}
+
+// The ValidateWrite of a register characteristic: writes the rules of the
+// characteristic reject are answered with the ATT error, recorded in the device
+// log if the register is a configuration register and reported on the write
+// status.
+func registerWriteValidator[T registerType](id bluetooth.UUID) func(client bluetooth.Connection, offset int, value []byte) error {
+	return func(client bluetooth.Connection, offset int, value []byte) error {
+		if _, code := checkRegisterWriteAt[T](id, offset, value); code != attSuccess {
+			auditConfigWrite(client, id, value, code)
+			rejectWrite(id, code, value)
+			return bluetooth.ATTError(code)
+		}
+		return nil
+	}
+}
+
+// Decode a write to a register and check it against the rules of the
+// characteristic. Writes reaching the write event already passed the
+// registerWriteValidator, writes rejected nonetheless are reported on the
+// write status and ok is false. Writes to configuration registers are
+// recorded in the device log.
+func decodeRegisterWrite[T registerType](client bluetooth.Connection, id bluetooth.UUID, offset int, value []byte) (result T, ok bool) {
+	result, code := checkRegisterWriteAt[T](id, offset, value)
+	auditConfigWrite(client, id, value, code)
+
+	if code != attSuccess {
+		rejectWrite(id, code, value)
+		return result, false
+	}
+	return result, true
+}
+
+// checkRegisterWrite of a write at offset. Registers are written whole, parts of
+// long writes are rejected.
+func checkRegisterWriteAt[T registerType](id bluetooth.UUID, offset int, value []byte) (result T, code byte) {
+	if offset != 0 {
+		return result, attErrorInvalidOffset
+	}
+	return checkRegisterWrite[T](id, value)
+}
+
+// Decode a register value and check it against the rules of the
+// characteristic. It returns attSuccess or the ATT error code the value is
+// rejected with. Integers shorter than the register are accepted, the app
+// writes small uint16 values as one byte.
+func checkRegisterWrite[T registerType](id bluetooth.UUID, value []byte) (result T, code byte) {
+	decoded, err := writeCodec(id, result).DecodeShort(value)
+	if err != nil {
+		println("Decoding write to", id.String(), "failed:", err.Error())
+		if errors.Is(err, codec.ErrLength) {
+			return result, attErrorInvalidLength
+		}
+		return result, attErrorValueNotAllowed
+	}
+	n, numeric := codec.Float(decoded)
+	if !numeric {
+		return result, attErrorValueNotAllowed
+	}
+
+	if code := validateWrite(id, n); code != attSuccess {
+		return result, code
+	}
+	// The schema type may be wider than the register
+	if result = T(n); float64(result) != n {
+		return result, attErrorOutOfRange
+	}
+	return result, attSuccess
+}
+
+// Check a decoded write against the rules of the characteristic. It returns
+// attSuccess or the ATT error code the write is rejected with.
+func validateWrite(id bluetooth.UUID, n float64) byte {
+	c, described := characteristicSchema[id]
+	return checkWriteRules(writeRules(id, c, described), n)
+}
+
+// Rules of a characteristic: the peripheral's limits and, if described, those
+// of its schema description c.
+func writeRules(id bluetooth.UUID, c schema.Characteristic, described bool) []writeRuleStruct {
+	rules := []writeRuleStruct{}
+	for target, rule := range peripheralWriteRules {
+		if *target == id {
+			rules = append(rules, rule)
+		}
+	}
+	if described {
+		rule := writeRuleStruct{min: math.Inf(-1), max: math.Inf(1), step: c.Step, options: c.SelectionOptions}
+		if len(c.Range) == 2 {
+			rule.min, rule.max = c.Range[0], c.Range[1]
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func checkWriteRules(rules []writeRuleStruct, n float64) byte {
+	for _, rule := range rules {
+		if n < rule.min || n > rule.max {
+			return attErrorOutOfRange
+		}
+		if rule.options != nil && !slices.Contains(rule.options, n) {
+			return attErrorValueNotAllowed
+		}
+		if rule.step != 0 && math.Remainder(n-rule.min, rule.step) != 0 {
+			return attErrorValueNotAllowed
+		}
+	}
+	return attSuccess
+}
+
+// Report a rejected write on the write status: the error code and the
+// characteristic. The central gets the ATT error from the write response, the
+// write status keeps the exact code where BlueZ reduces it to an application
+// error, see writeError in third_party/bluetooth/bluetooth.patch.
+func rejectWrite(id bluetooth.UUID, code byte, value []byte) {
+	name := id.String()
+	if c, ok := characteristicSchema[id]; ok {
+		name = c.Name
+	}
+	println("Rejected write to", name, "value", fmt.Sprintf("%x", value), "error", fmt.Sprintf("0x%02X", code))
+
+	publishWriteStatus(code, id)
+}
+
+func acceptWrite(id bluetooth.UUID) {
+	publishWriteStatus(attSuccess, id)
+}
+
+// Write status: uint8 ATT error code, 0 after an accepted write, followed by
+// the characteristic UUID, 16 bytes little endian.
+func publishWriteStatus(code byte, id bluetooth.UUID) {
+	raw := id.Bytes()
+	writeStatusHandle.Write(append([]byte{code}, raw[:]...))
+}
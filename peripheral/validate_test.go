@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+
+	"go-ble/schema"
+
+	"github.com/google/uuid"
+	"tinygo.org/x/bluetooth"
+)
+
+// Describe characteristics for the duration of a test.
+func useTestSchema(t *testing.T, mappings string) {
+	t.Helper()
+	s, err := schema.Parse([]byte(`{"characteristic_mappings": {` + mappings + `}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range s.Characteristics {
+		characteristicSchema[bluetooth.NewUUID(uuid.MustParse(c.UUID))] = c
+	}
+	t.Cleanup(func() { clear(characteristicSchema) })
+}
+
+func TestValidateWrite(t *testing.T) {
+	useTestSchema(t, `
+		"`+transmitPowerCharacteristicUUID.String()+`": {"name": "TX", "data_type": "int8", "editing": "selection", "selection_options": [-3, 0, 3]},
+		"`+advDurationCharacteristicUUID.String()+`": {"name": "Duration", "data_type": "uint16", "editing": "write", "range": [10, 100], "step": 5}`)
+
+	tests := []struct {
+		name string
+		id   bluetooth.UUID
+		n    float64
+		want byte
+	}{
+		{"option", transmitPowerCharacteristicUUID, -3, attSuccess},
+		{"not an option", transmitPowerCharacteristicUUID, 1, attErrorValueNotAllowed},
+		{"range minimum", advDurationCharacteristicUUID, 10, attSuccess},
+		{"range maximum", advDurationCharacteristicUUID, 100, attSuccess},
+		{"below range", advDurationCharacteristicUUID, 5, attErrorOutOfRange},
+		{"above range", advDurationCharacteristicUUID, 105, attErrorOutOfRange},
+		{"on the step grid", advDurationCharacteristicUUID, 55, attSuccess},
+		{"off the step grid", advDurationCharacteristicUUID, 12, attErrorValueNotAllowed},
+		{"peripheral limit", sensorODRCharacteristicUUID, 0, attErrorOutOfRange},
+		{"within peripheral limit", sensorODRCharacteristicUUID, 2500, attSuccess},
+		{"bit", autoDisconnectBitCharacteristicUUID, 2, attErrorOutOfRange},
+		{"undescribed, no limits", bootCountCharacteristicUUID, 1e9, attSuccess},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := validateWrite(test.id, test.n); code != test.want {
+				t.Errorf("validateWrite(%v) = 0x%02X, want 0x%02X", test.n, code, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckRegisterWrite(t *testing.T) {
+	useTestSchema(t, `
+		"`+transmitPowerCharacteristicUUID.String()+`": {"name": "TX", "data_type": "int8", "editing": "selection", "selection_options": [-3, 0, 3]},
+		"`+responseTimeoutCharacteristicUUID.String()+`": {"name": "Timeout", "data_type": "uint16", "editing": "write", "range": [0, 1000]},
+		"`+sensorDataClearBitCharacteristicUUID.String()+`": {"name": "Clear", "data_type": "bool"}`)
+
+	t.Run("int8", func(t *testing.T) {
+		for _, test := range []struct {
+			value []byte
+			want  int8
+			code  byte
+		}{
+			{[]byte{0xFD}, -3, attSuccess},
+			{[]byte{0x03}, 3, attSuccess},
+			{[]byte{0x02}, 0, attErrorValueNotAllowed},
+			{[]byte{}, 0, attErrorInvalidLength},
+			{[]byte{0xFD, 0xFF}, 0, attErrorInvalidLength},
+		} {
+			n, code := checkRegisterWrite[int8](transmitPowerCharacteristicUUID, test.value)
+			if code != test.code || (code == attSuccess && n != test.want) {
+				t.Errorf("%x: %d, 0x%02X, want %d, 0x%02X", test.value, n, code, test.want, test.code)
+			}
+		}
+	})
+
+	t.Run("schema wider than the register", func(t *testing.T) {
+		for _, test := range []struct {
+			value []byte
+			want  uint8
+			code  byte
+		}{
+			{[]byte{200, 0}, 200, attSuccess},
+			{[]byte{200}, 200, attSuccess},              // Short integers are accepted
+			{[]byte{0x2C, 0x01}, 0, attErrorOutOfRange}, // 300 is within the schema range, not the register
+			{[]byte{0xE9, 0x03}, 0, attErrorOutOfRange}, // 1001 is beyond the schema range
+		} {
+			n, code := checkRegisterWrite[uint8](responseTimeoutCharacteristicUUID, test.value)
+			if code != test.code || (code == attSuccess && n != test.want) {
+				t.Errorf("%x: %d, 0x%02X, want %d, 0x%02X", test.value, n, code, test.want, test.code)
+			}
+		}
+	})
+
+	t.Run("bool", func(t *testing.T) {
+		if n, code := checkRegisterWrite[uint8](sensorDataClearBitCharacteristicUUID, []byte{1}); n != 1 || code != attSuccess {
+			t.Errorf("1: %d, 0x%02X", n, code)
+		}
+		if _, code := checkRegisterWrite[uint8](sensorDataClearBitCharacteristicUUID, []byte{2}); code != attErrorValueNotAllowed {
+			t.Errorf("2: 0x%02X, want 0x%02X", code, attErrorValueNotAllowed)
+		}
+	})
+
+	t.Run("undescribed register uses its Go type", func(t *testing.T) {
+		if n, code := checkRegisterWrite[uint16](sensorODRCharacteristicUUID, []byte{0xC4, 0x09}); n != 2500 || code != attSuccess {
+			t.Errorf("2500: %d, 0x%02X", n, code)
+		}
+		if _, code := checkRegisterWrite[uint16](sensorODRCharacteristicUUID, []byte{0, 0}); code != attErrorOutOfRange {
+			t.Errorf("0: 0x%02X, want 0x%02X", code, attErrorOutOfRange)
+		}
+		if _, code := checkRegisterWrite[uint16](sensorODRCharacteristicUUID, []byte{1, 2, 3}); code != attErrorInvalidLength {
+			t.Errorf("3 bytes: 0x%02X, want 0x%02X", code, attErrorInvalidLength)
+		}
+	})
+
+	t.Run("long write", func(t *testing.T) {
+		if _, code := checkRegisterWriteAt[int8](transmitPowerCharacteristicUUID, 1, []byte{0}); code != attErrorInvalidOffset {
+			t.Errorf("offset 1: 0x%02X, want 0x%02X", code, attErrorInvalidOffset)
+		}
+	})
+}